@@ -0,0 +1,301 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Accounts are appended to this file, one JSON object per line.
+var ACCOUNT_STORE_PATH string = "accounts.jsonl"
+
+// The name of the cookie that holds a player's login token. The token is checked before a websocket is accepted.
+const LOGIN_COOKIE string = "login"
+
+// How long a login lasts before the player has to log in again. Logins are only kept in memory, so restarting the server also ends
+// them.
+const LOGIN_DURATION time.Duration = 7 * 24 * time.Hour
+
+// Passwords are hashed with PBKDF2-SHA256 using this many iterations. It's stored with each account so it can be raised later
+// without breaking old accounts.
+const PASSWORD_ITERATIONS int = 100000
+
+const MIN_PASSWORD_LENGTH int = 8
+
+// Usernames are shown to everyone and used in URLs, so they're kept simple. Names the server uses itself are reserved.
+var USERNAME_PATTERN = regexp.MustCompile(`^[A-Za-z0-9_-]{1,20}$`)
+var RESERVED_USERNAMES = map[string]bool{"server": true, "anonymous": true}
+
+var errWrongPassword = errors.New("wrong username or password")
+var errNameTaken = errors.New("that username is taken")
+
+// An Account is a registered player. Only a salted hash of the password is kept.
+type Account struct {
+	Name       string    `json:"name"`
+	Salt       []byte    `json:"salt"`
+	Hash       []byte    `json:"hash"`
+	Iterations int       `json:"iterations"`
+	Created    time.Time `json:"created"`
+}
+
+type login struct {
+	name    string
+	expires time.Time
+}
+
+// Accounts keeps track of every registered account and who is logged in. It's used from the HTTP handlers, so like the match stores it
+// has its own mutex. If it was opened from a file, new accounts are appended to it.
+type Accounts struct {
+	mutex    sync.Mutex
+	accounts map[string]Account
+	logins   map[string]login
+	file     *os.File
+}
+
+// NewAccounts makes an Accounts that forgets everything when the server stops.
+func NewAccounts() *Accounts {
+	return &Accounts{accounts: make(map[string]Account), logins: make(map[string]login)}
+}
+
+func OpenAccounts(path string) (*Accounts, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	accounts := NewAccounts()
+	accounts.file = file
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var account Account
+		if err := json.Unmarshal(scanner.Bytes(), &account); err != nil {
+			file.Close()
+			return nil, err
+		}
+		accounts.accounts[account.Name] = account
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return accounts, nil
+}
+
+func (a *Accounts) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+func hashPassword(password string, salt []byte, iterations int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, iterations, 32)
+}
+
+func newToken() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// Register creates an account. It returns an error meant for the player if the name or password isn't acceptable.
+func (a *Accounts) Register(name, password string) error {
+	if !USERNAME_PATTERN.MatchString(name) || RESERVED_USERNAMES[name] {
+		return errors.New("usernames must be 1 to 20 letters, numbers, dashes or underscores")
+	}
+	if len(password) < MIN_PASSWORD_LENGTH {
+		return errors.New("passwords must be at least 8 characters")
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password, salt, PASSWORD_ITERATIONS)
+	if err != nil {
+		return err
+	}
+	account := Account{Name: name, Salt: salt, Hash: hash, Iterations: PASSWORD_ITERATIONS, Created: time.Now()}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, ok := a.accounts[name]; ok {
+		return errNameTaken
+	}
+	if a.file != nil {
+		line, err := json.Marshal(account)
+		if err != nil {
+			return err
+		}
+		if _, err := a.file.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	a.accounts[name] = account
+	return nil
+}
+
+// Login checks a player's password and returns a new login token for them.
+func (a *Accounts) Login(name, password string) (string, error) {
+	a.mutex.Lock()
+	account, ok := a.accounts[name]
+	a.mutex.Unlock()
+	if !ok {
+		return "", errWrongPassword
+	}
+	hash, err := hashPassword(password, account.Salt, account.Iterations)
+	if err != nil {
+		return "", err
+	}
+	if subtle.ConstantTimeCompare(hash, account.Hash) != 1 {
+		return "", errWrongPassword
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.logins[token] = login{name: name, expires: time.Now().Add(LOGIN_DURATION)}
+	return token, nil
+}
+
+func (a *Accounts) Logout(token string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.logins, token)
+}
+
+// LoggedIn returns the name of the player a login token belongs to, if it's still good.
+func (a *Accounts) LoggedIn(token string) (string, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	login, ok := a.logins[token]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(login.expires) {
+		delete(a.logins, token)
+		return "", false
+	}
+	return login.name, true
+}
+
+// loggedInUser returns the name of the player who made a request, going by their login cookie.
+func loggedInUser(accounts *Accounts, r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(LOGIN_COOKIE)
+	if err != nil {
+		return "", false
+	}
+	return accounts.LoggedIn(cookie.Value)
+}
+
+// Credentials are what the login and registration forms send, as JSON.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// readCredentials decodes the credentials in a POST request. If it fails, it has already sent the error response.
+func readCredentials(w http.ResponseWriter, r *http.Request) (Credentials, bool) {
+	var credentials Credentials
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return credentials, false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&credentials); err != nil {
+		http.Error(w, "expected a JSON object with a username and password", http.StatusBadRequest)
+		return credentials, false
+	}
+	return credentials, true
+}
+
+// logIn checks credentials and sets the login cookie, then tells the client who they are.
+func logIn(accounts *Accounts, w http.ResponseWriter, r *http.Request, credentials Credentials) {
+	token, err := accounts.Login(credentials.Username, credentials.Password)
+	if err == errWrongPassword {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     LOGIN_COOKIE,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(LOGIN_DURATION),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"username": credentials.Username})
+}
+
+// serveRegister creates an account and logs in to it.
+func serveRegister(accounts *Accounts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credentials, ok := readCredentials(w, r)
+		if !ok {
+			return
+		}
+		if err := accounts.Register(credentials.Username, credentials.Password); err == errNameTaken {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logIn(accounts, w, r, credentials)
+	})
+}
+
+func serveLogin(accounts *Accounts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if credentials, ok := readCredentials(w, r); ok {
+			logIn(accounts, w, r, credentials)
+		}
+	})
+}
+
+func serveLogout(accounts *Accounts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if cookie, err := r.Cookie(LOGIN_COOKIE); err == nil {
+			accounts.Logout(cookie.Value)
+		}
+		http.SetCookie(w, &http.Cookie{Name: LOGIN_COOKIE, Value: "", Path: "/", MaxAge: -1})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// serveMe tells the client who it's logged in as, so the page knows whether to show the login form.
+func serveMe(accounts *Accounts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := loggedInUser(accounts, r)
+		if !ok {
+			http.Error(w, "not logged in", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"username": name})
+	})
+}
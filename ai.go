@@ -0,0 +1,232 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Practice matches against the computer use this difficulty if the player doesn't pick one.
+const DEFAULT_DIFFICULTY string = "normal"
+
+// How many cycles before a light attack lands the computer starts blocking it, when it blocks reactively. Blocking at the last
+// moment is what makes a block count as reactive, which counters the attack.
+const AI_BLOCK_LEAD int = 15
+
+// A Difficulty describes how well the computer plays.
+// ReactionTicks is how many cycles old the updates the computer acts on are, like a human's reaction time.
+// ReactChance is the chance that it responds to an attack at all.
+// ReactiveBlock makes it wait until the last moment to block light attacks so that they get countered; otherwise it blocks as soon as
+// it sees them coming.
+// DodgeHeavy and InterruptHeavy let it dodge heavy attacks and interrupt them with light attacks instead of only blocking them.
+// Aggression is the chance each cycle that it starts an attack when it's free to.
+// Accuracy is the chance that it presses the right arrow in an interrupt.
+type Difficulty struct {
+	Name           string
+	ReactionTicks  int
+	ReactChance    float64
+	ReactiveBlock  bool
+	DodgeHeavy     bool
+	InterruptHeavy bool
+	Aggression     float64
+	Accuracy       float64
+}
+
+var DIFFICULTIES = map[string]Difficulty{
+	"easy":   {Name: "easy", ReactionTicks: 35, ReactChance: 0.4, Aggression: 0.005, Accuracy: 0.5},
+	"normal": {Name: "normal", ReactionTicks: 22, ReactChance: 0.7, ReactiveBlock: true, DodgeHeavy: true, Aggression: 0.01, Accuracy: 0.75},
+	"hard":   {Name: "hard", ReactionTicks: 12, ReactChance: 0.95, ReactiveBlock: true, DodgeHeavy: true, InterruptHeavy: true, Aggression: 0.02, Accuracy: 0.95},
+}
+
+// listDifficulties describes the difficulties players can pick for practice.
+func listDifficulties() string {
+	names := make([]string, 0, len(DIFFICULTIES))
+	for name := range DIFFICULTIES {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// A Bot is a computer player. Like a human's client, it gets the newest Update every cycle and returns the command to send, or an empty
+// string to keep doing what it's doing. AIPlayer and Dummy are Bots, and the league in league.go plays any of them against each other.
+type Bot interface {
+	Act(update Update) string
+}
+
+// AIPlayer is a computer opponent. It sees the same Updates a human's client gets and answers with the same commands a human's
+// client sends.
+type AIPlayer struct {
+	Difficulty Difficulty
+	Rules      *Rules
+	random     *rand.Rand
+	// The most recent updates, oldest first. The computer acts on the oldest one to simulate reaction time.
+	seen []Update
+	// How the computer decided to deal with the enemy's current attack, so it only decides once per attack.
+	response    string
+	lastEnemy   State
+	lastCommand string
+}
+
+func NewAIPlayer(difficulty Difficulty, rules *Rules, seed int64) *AIPlayer {
+	return &AIPlayer{Difficulty: difficulty, Rules: rules, random: rand.New(rand.NewSource(seed)), seen: make([]Update, 0, difficulty.ReactionTicks+1), lastCommand: "NONE"}
+}
+
+// Act takes the newest Update and returns the command to send, or an empty string if there's nothing new to send. Like a human
+// holding the block key, a block is only sent once and lasts until "NONE" is sent.
+func (ai *AIPlayer) Act(update Update) string {
+	ai.seen = append(ai.seen, update)
+	if len(ai.seen) <= ai.Difficulty.ReactionTicks {
+		return ""
+	}
+	update = ai.seen[0]
+	ai.seen = append(ai.seen[:0], ai.seen[1:]...)
+
+	command := ai.decide(update.Self, update.Enemy)
+	if command == "NONE" && ai.lastCommand != "BLOCK" {
+		return ""
+	}
+	ai.lastCommand = command
+	return command
+}
+
+func (ai *AIPlayer) decide(self, enemy PlayerStatus) string {
+	rules := ai.Rules
+	if self.State == Countered {
+		return "SAVE"
+	}
+	if arrow := STATES[self.State].Arrow; arrow != "" {
+		if ai.random.Float64() >= ai.Difficulty.Accuracy {
+			arrow = STATES[INTERRUPTING_STATES[ai.random.Intn(4)]].Arrow
+		}
+		return "INTERRUPT_" + strings.ToUpper(arrow)
+	}
+	if !INTERRUPTABLE_STATES[self.State] {
+		return "NONE"
+	}
+
+	// Decide once how to deal with each new attack.
+	if enemy.State != ai.lastEnemy {
+		ai.lastEnemy = enemy.State
+		ai.response = ""
+		if ATTACK_STATES[enemy.State] && ai.random.Float64() < ai.Difficulty.ReactChance {
+			ai.response = ai.chooseResponse(self, enemy)
+		}
+	}
+	// By the time a command arrives, the attack is ReactionTicks further along than what the computer sees.
+	remaining := enemy.StateDuration - ai.Difficulty.ReactionTicks
+	switch ai.response {
+	case "BLOCK":
+		if !ai.Difficulty.ReactiveBlock || enemy.State != LightAttack || remaining <= AI_BLOCK_LEAD {
+			return "BLOCK"
+		}
+		return "NONE"
+	case "DODGE":
+		if remaining <= rules.DodgeWindow+AI_BLOCK_LEAD {
+			ai.response = ""
+			return "DODGE"
+		}
+		return "NONE"
+	case "LIGHT":
+		ai.response = ""
+		return "LIGHT"
+	}
+
+	// Nothing to respond to, so maybe attack.
+	if ai.random.Float64() < ai.Difficulty.Aggression {
+		if ai.random.Intn(2) == 0 && self.Stamina >= rules.HeavyAttackCost {
+			return "HEAVY"
+		} else if self.Stamina >= rules.LightAttackCost {
+			return "LIGHT"
+		}
+	}
+	// Keep blocking while the enemy is still attacking, otherwise let go.
+	if self.State == Blocking && ATTACK_STATES[enemy.State] {
+		return "BLOCK"
+	}
+	return "NONE"
+}
+
+// chooseResponse picks how to deal with an attack the enemy just started.
+func (ai *AIPlayer) chooseResponse(self, enemy PlayerStatus) string {
+	rules := ai.Rules
+	if enemy.State == HeavyAttack {
+		remaining := enemy.StateDuration - ai.Difficulty.ReactionTicks
+		if ai.Difficulty.InterruptHeavy && self.Stamina >= rules.LightAttackCost && remaining > rules.LightAttackSpeed {
+			return "LIGHT"
+		}
+		if ai.Difficulty.DodgeHeavy && self.Stamina >= rules.DodgeCost && remaining > rules.DodgeWindow {
+			return "DODGE"
+		}
+	}
+	return "BLOCK"
+}
+
+// runBot plays a battle as the computer. It reads updates and sends commands at the same time, so that the battle is never stuck
+// waiting for it to take an update while it's waiting to send a command.
+func runBot(bot Bot, updates <-chan Update, inputs chan<- BattleInput) {
+	var pending chan<- BattleInput
+	var next BattleInput
+	for {
+		select {
+		case update := <-updates:
+			if command := bot.Act(update); command != "" {
+				next = BattleInput{Command: command}
+				pending = inputs
+			}
+			if update.Over {
+				return
+			}
+		case pending <- next:
+			pending = nil
+		}
+	}
+}
+
+// startPractice starts a match between a user and the computer, under the rules of the user's room.
+func (l *lobby) startPractice(conn *ConnInfo, difficultyName string) string {
+	if difficultyName == "" {
+		difficultyName = DEFAULT_DIFFICULTY
+	}
+	difficulty, ok := DIFFICULTIES[difficultyName]
+	if !ok {
+		return "There is no difficulty called " + difficultyName + ". Pick one of " + listDifficulties() + "."
+	}
+	rules := l.clients[conn].Room.Rules
+	conn.Outbound <- serverMessage("You are fighting the computer on " + difficulty.Name + " difficulty.")
+	botInputs, botUpdates := l.startComputerMatch(conn, "computer ("+difficulty.Name+")", rules, nil)
+	go runBot(NewAIPlayer(difficulty, rules, time.Now().UnixNano()), botUpdates, botInputs)
+	return ""
+}
+
+// startComputerMatch takes a user out of whatever they were doing and starts a battle between them and the computer, which plays
+// player 2 through the channels it returns. training is nil unless it's a training match.
+func (l *lobby) startComputerMatch(conn *ConnInfo, botName string, rules *Rules, training *Training) (chan BattleInput, chan Update) {
+	user := l.clients[conn]
+	l.unready(conn)
+	stopSpectating(user)
+	for challenger := range user.Challengers {
+		delete(user.Challengers, challenger)
+	}
+	user.InGame = true
+	conn.Outbound <- gameMessage(TYPE_START_GAME, rules)
+
+	match := NewMatch(l.nextMatchID, user.Name, botName, rules, l.results)
+	match.Practice = true
+	match.Training = training
+	user.Match, user.Side = match, 0
+	l.matches[match.ID] = match
+	l.running[match] = true
+	l.nextMatchID++
+	botInputs := make(chan BattleInput)
+	botUpdates := make(chan Update)
+	go battle(match, user.BattleInputChan, botInputs, user.BattleUpdateChan, botUpdates)
+	go forwardUpdates(conn.Outbound, user.BattleUpdateChan)
+	return botInputs, botUpdates
+}
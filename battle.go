@@ -6,34 +6,41 @@
 package main
 
 import (
-	"log"
-	"math/rand"
+	"fmt"
 	"strings"
 	"time"
 )
 
-// These two channels are the same as the two from the corresponding User struct in server.go.
-// The Command field is the current input from the player (kept up to date by the concurrently running input func for the player).
-// The state field keeps track of what the player is doing. It has values like "standing", "blocking", "light attack", etc.
+// The Command field is the current input from the player. The driver in battle() keeps it up to date through Simulation.Step.
+// The State field keeps track of what the player is doing, like Standing, Blocking, LightAttack, etc. See state.go for all of them.
 // The StateDuration field shows how much longer the player will remain in their current state.
 // The Finished field shows what state the player just exited. It's used to know when an attack is supposed to land.
+// The Stats field counts what the player has accomplished so far in the match.
 type Player struct {
 	Name          string
-	InputChan     chan Message
-	UpdateChan    chan Update
 	Command       string
 	Life          int
 	Stamina       float32
-	State         string
+	State         State
 	StateDuration int
-	Finished      string
+	Finished      State
+	Stats         BattleStats
+}
+
+// BattleStats are the running totals for one player in one match. They're kept for match history and don't affect the battle.
+type BattleStats struct {
+	DamageDealt   int `json:"damageDealt"`
+	Counters      int `json:"counters"`
+	InterruptsWon int `json:"interruptsWon"`
+	Blocks        int `json:"blocks"`
+	Dodges        int `json:"dodges"`
 }
 
 // This struct is passed instead of Player to the client in Updates so that unneeded fields like the channels aren't passed.
 type PlayerStatus struct {
 	Life          int     `json:"life"`
 	Stamina       float32 `json:"stamina"`
-	State         string  `json:"state"`
+	State         State   `json:"state"`
 	StateDuration int     `json:"stateDur"`
 }
 
@@ -43,206 +50,473 @@ func (p *Player) Status() PlayerStatus {
 }
 
 // This is called every mainloop cycle, and does two things: regenerate stamina, and make progress toward exiting the current state.
-func (p *Player) PassTime(amount int) {
-	p.Stamina += 0.1
-	if p.Stamina > 100 {
-		p.Stamina = 100
+func (p *Player) PassTime(amount int, rules *Rules) error {
+	p.Stamina += rules.StaminaRegen
+	if p.Stamina > rules.MaxStamina {
+		p.Stamina = rules.MaxStamina
 	}
 	p.StateDuration -= amount
-	// If it starts with "interrupt", it's one of the heavy attack interrupt states. There are eight of them, so I didn't think it was practical to just list them all.
-	if p.StateDuration <= 0 && !INTERRUPTABLE_STATES[p.State] && !strings.HasPrefix(p.State, "interrupt") {
+	if p.StateDuration <= 0 && !TERMINAL_STATES[p.State] {
 		p.Finished = p.State
-		p.State = "standing"
+		return p.SetState(Standing, rules)
 	}
+	return nil
 }
 
-func (p *Player) SetState(state string, duration int) {
+// SetState moves the player into a new state for as long as the transition table says it lasts. If the table doesn't allow the
+// transition, the player is left alone and an error is returned.
+func (p *Player) SetState(state State, rules *Rules) error {
+	if !p.State.CanBecome(state) {
+		return fmt.Errorf("illegal state transition from %q to %q", p.State, state)
+	}
 	p.State = state
-	p.StateDuration = duration
+	p.StateDuration = 0
+	if duration := STATES[state].Duration; duration != nil {
+		p.StateDuration = duration(rules)
+	}
+	return nil
+}
+
+// Hit takes life away from the enemy and credits the player with the damage.
+func (p *Player) Hit(enemy *Player, damage int) {
+	enemy.Life -= damage
+	p.Stats.DamageDealt += damage
 }
 
 // One of these is sent back to each player every mainloop cycle. Note that the players don't know which player they are internally - it doesn't matter.
+// Tick is how many cycles had been simulated when the update was made. Clients tag their inputs with the Tick of the newest update they
+// have, and Ack is the newest tag the server has received from this player, so the client knows which of its inputs are reflected.
+// Round is the round being fought, starting at 1, and Wins and EnemyWins are how many rounds each side has won. TimeLeft is how many
+// cycles are left in the round, and is left out if rounds have no time limit. RoundOver is set during the break after a round.
+// EnemyDisconnected is set while the battle is paused because the enemy lost their connection. Over is set on the last update of the
+// match, and EnemyForfeited on the last update of a match the enemy lost by not coming back in time.
 type Update struct {
-	Self  PlayerStatus `json:"self"`
-	Enemy PlayerStatus `json:"enemy"`
-}
-
-// constants
-const LIGHT_ATK_DMG int = 3
-const LIGHT_ATK_SPD int = 50
-const LIGHT_ATK_COST float32 = 10.0
-const LIGHT_ATK_BLK_COST float32 = 12.0
-const LIGHT_ATK_CNTR_SPD int = 30
-const LIGHT_ATK_CNTR_DMG int = 3
-const HEAVY_ATK_DMG int = 6
-const HEAVY_ATK_SPD int = 100
-const HEAVY_ATK_COST float32 = 15.0
-const HEAVY_ATK_BLK_COST float32 = 20.0
-const HEAVY_ATK_BLKED_DMG int = 2
-const DODGE_COST float32 = 20.0
-const DODGE_WINDOW int = 30
-
-//INTERRUPTABLE_STATES := map[string]bool{"standing":true,"blocking":true}
-//TERMINAL_STATES := map[string]bool{"standing":true,"blocking":true,"countered":true}
-var INTERRUPTABLE_STATES map[string]bool = map[string]bool{"standing": true, "blocking": true}
-var TERMINAL_STATES map[string]bool = map[string]bool{"standing": true, "blocking": true, "countered": true}
-var ATTACK_STATES map[string]bool = map[string]bool{"light attack": true, "heavy attack": true}
-var INTERRUPT_RESOLVE_KEYS []string = []string{"_up", "_down", "_left", "_right"}
-
-func battle(player1inputChan, player2inputChan chan Message, player1updateChan, player2updateChan chan Update) {
-	log.Println("in battle")
+	Self              PlayerStatus `json:"self"`
+	Enemy             PlayerStatus `json:"enemy"`
+	Tick              int          `json:"tick"`
+	Ack               int          `json:"ack"`
+	Round             int          `json:"round"`
+	Wins              int          `json:"wins"`
+	EnemyWins         int          `json:"enemyWins"`
+	TimeLeft          int          `json:"timeLeft,omitempty"`
+	RoundOver         bool         `json:"roundOver,omitempty"`
+	EnemyDisconnected bool         `json:"enemyDisconnected,omitempty"`
+	Over              bool         `json:"over,omitempty"`
+	EnemyForfeited    bool         `json:"enemyForfeited,omitempty"`
+}
+
+// A BattleInput is a command from a player. Tick is the tick of the newest Update they had when they pressed it, or 0 if the
+// command should just be used on the next cycle.
+type BattleInput struct {
+	Command string
+	Tick    int
+}
+
+// How long each mainloop cycle of a live battle takes. The rules are written for 10ms cycles, so changing this speeds up or slows down
+// the game. It can be set in the config.
+var TICK_INTERVAL time.Duration = 10 * time.Millisecond
+
+// Simulation holds the complete state of one match and advances it one mainloop cycle at a time. It has no clock and no channels, so the
+// same seed and the same inputs always produce the same match. That makes it usable outside of the battle() goroutine, e.g. for tests,
+// fast-forwarded simulations and bots. Copying a Simulation saves its whole state, which is how rollbacks work; the Rules are shared,
+// but they never change during a match.
+type Simulation struct {
+	Players [2]Player
+	Rules   *Rules
+	// The number of cycles that have been simulated so far.
+	Tick int
+	// The round being fought, starting at 1, how many rounds each player has won, and how many cycles the round has lasted.
+	Round     int
+	Wins      [2]int
+	RoundTick int
+	// How many cycles are left in the break after a round, or 0 while a round is being fought.
+	Break int
+	// The settings of a training match. See training.go.
+	Training TrainingSettings
+	over     bool
+	random   rng
+}
+
+// How many cycles the battle stops for after each round, so the players can see how it ended before the next one starts.
+const ROUND_BREAK int = 100
+
+// rng is a small random number generator (splitmix64). Unlike math/rand, its whole state is one number, so copying it saves it.
+type rng struct {
+	state uint64
+}
+
+func (r *rng) Intn(n int) int {
+	r.state += 0x9e3779b97f4a7c15
+	z := r.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return int(z % uint64(n))
+}
+
+// NewSimulation returns a Simulation at the start of the first round. The seed is used for everything random in the match.
+func NewSimulation(seed int64, rules *Rules) *Simulation {
+	s := &Simulation{Rules: rules, random: rng{state: uint64(seed)}}
+	s.startRound()
+	return s
+}
+
+// startRound puts both players back in their starting state for the next round. Their stats carry over, since they're for the whole
+// match.
+func (s *Simulation) startRound() {
+	s.Round++
+	s.RoundTick = 0
+	s.resetPlayers()
+}
+
+func (s *Simulation) resetPlayers() {
+	for i := range s.Players {
+		s.Players[i] = Player{Command: "NONE", Life: s.Rules.StartingLife, Stamina: s.Rules.StartingStamina, State: Standing, StateDuration: 0, Finished: NoState, Stats: s.Players[i].Stats}
+	}
+}
+
+// endRound ends the round if either player has run out of life or the round has run out of time. Whoever has more life left wins the
+// round, so running out of life on the same cycle as the enemy, or having as much life as them when time runs out, is a draw. The match
+// is over once someone has won most of the rounds or every round has been fought; otherwise the break before the next round starts.
+func (s *Simulation) endRound() {
+	timeUp := s.Rules.RoundTime > 0 && s.RoundTick >= s.Rules.RoundTime
+	if s.Players[0].Life > 0 && s.Players[1].Life > 0 && !timeUp {
+		return
+	}
+	life0, life1 := max(s.Players[0].Life, 0), max(s.Players[1].Life, 0)
+	if life0 > life1 {
+		s.Wins[0]++
+	} else if life1 > life0 {
+		s.Wins[1]++
+	}
+	needed := s.Rules.Rounds/2 + 1
+	if s.Wins[0] >= needed || s.Wins[1] >= needed || s.Round >= s.Rules.Rounds {
+		s.over = true
+		return
+	}
+	s.Break = ROUND_BREAK
+}
+
+// Step advances the match by one mainloop cycle and returns the resulting Update for each player. inputs holds the newest command from
+// each player; an empty string means no new input arrived, so the player keeps their previous command (this is how a held block works).
+// If the rules tried to make an illegal state transition, the cycle still completes and the first such error is returned. Once the match
+// is over, Step does nothing.
+func (s *Simulation) Step(inputs [2]string) ([2]Update, error) {
+	// Nothing happens once the match is over, so the last round can't be counted twice.
+	if s.over {
+		return s.Updates(), nil
+	}
+	if s.Break > 0 {
+		// Nothing happens between rounds, and inputs are ignored.
+		s.Break--
+		if s.Break == 0 {
+			s.startRound()
+		}
+		s.Tick++
+		return s.Updates(), nil
+	}
+	var err error
+	for p, input := range inputs {
+		if input != "" {
+			s.Players[p].Command = input
+		}
+	}
+	for p := range s.Players {
+		player := &s.Players[p]
+		err = firstError(err, player.PassTime(1, s.Rules))
+		// Set the 'enemy' var to the other player, we'll need it later.
+		enemy := &s.Players[1-p]
+		if player.Finished != NoState {
+			err = firstError(err, resolveState(player, enemy, s.Rules))
+		}
+		err = firstError(err, resolveCommand(player, enemy, s.Rules, &s.random))
+	}
+	s.applyTraining()
+	s.Tick++
+	s.RoundTick++
+	s.endRound()
+	return s.Updates(), err
+}
+
+// Updates returns what each player currently sees. The first Update is for player 1 and the second is for player 2.
+func (s *Simulation) Updates() [2]Update {
+	var updates [2]Update
+	for p := range updates {
+		updates[p] = Update{
+			Self:      s.Players[p].Status(),
+			Enemy:     s.Players[1-p].Status(),
+			Tick:      s.Tick,
+			Round:     s.Round,
+			Wins:      s.Wins[p],
+			EnemyWins: s.Wins[1-p],
+			RoundOver: s.Break > 0,
+		}
+		if s.Rules.RoundTime > 0 {
+			updates[p].TimeLeft = s.Rules.RoundTime - s.RoundTick
+		}
+	}
+	return updates
+}
+
+// Over reports whether the match has ended. See endRound for when that happens.
+func (s *Simulation) Over() bool {
+	return s.over
+}
+
+// battle runs a match in real time. It's a thin driver around Simulation: it collects inputs from the players' channels, steps the
+// simulation once every 10ms through a Rollback so that late inputs still count, and sends the results back through the update
+// channels and to anyone spectating the match.
+func battle(match *Match, player1inputChan, player2inputChan chan BattleInput, player1updateChan, player2updateChan chan Update) {
+	logDebug("in battle")
 	// Seed the random number generator and initialize the clock and players.
-	random := rand.New(rand.NewSource(time.Now().UnixNano()))
-	ticker := time.NewTicker(10 * time.Millisecond)
-	defer ticker.Stop()
-	players := []*Player{&Player{InputChan: player1inputChan, UpdateChan: player1updateChan, Command: "NONE", Life: 100, Stamina: 100, State: "standing", StateDuration: 0, Finished: ""}, &Player{InputChan: player2inputChan, UpdateChan: player2updateChan, Command: "NONE", Life: 100, Stamina: 100, State: "standing", StateDuration: 0, Finished: ""}}
-	for players[0].Life > 0 && players[1].Life > 0 {
+	seed := time.Now().UnixNano()
+	sim := NewSimulation(seed, match.Rules)
+	rollback := NewRollback(sim)
+	replay := NewReplay(seed, match.Rules)
+	clock := NewClock(match.ID, TICK_INTERVAL)
+	inputChans := [2]chan BattleInput{player1inputChan, player2inputChan}
+	updateChans := [2]chan Update{player1updateChan, player2updateChan}
+	spectators := make(map[chan SpectatorUpdate]bool)
+	// When each player lost their connection, or the zero time if they're connected. The battle is paused while anyone is
+	// disconnected, and whoever stays disconnected for too long forfeits.
+	var trainingChanges chan TrainingChange
+	if match.Training != nil {
+		trainingChanges = match.Training.Changes
+	}
+	var disconnected [2]time.Time
+	var forfeited [2]bool
+	// Set if the server stopped the battle before it finished.
+	stopped := false
+	updates := rollback.Updates()
+	for !rollback.Over() && !forfeited[0] && !forfeited[1] && !stopped {
 		select {
-		// Each mainloop cycle:
-		case <-ticker.C:
-			players[0].UpdateChan <- Update{Self: players[0].Status(), Enemy: players[1].Status()}
-			players[1].UpdateChan <- Update{Self: players[1].Status(), Enemy: players[0].Status()}
-			for p, player := range players {
-				player.PassTime(1)
-				// Set the 'enemy' var to the other player, we'll need it later.
-				enemy := players[1]
-				if p == 1 {
-					enemy = players[0]
+		// Each time the clock goes off, run however many mainloop cycles are due. The players only get the updates from the last
+		// one, since the earlier ones would be out of date by the time they arrived.
+		case <-clock.C():
+			cycles := clock.Due()
+			paused := false
+			for p := range disconnected {
+				if !disconnected[p].IsZero() {
+					paused = true
+					updates[1-p].EnemyDisconnected = true
+					forfeited[p] = time.Since(disconnected[p]) > RECONNECT_GRACE
 				}
-				if player.Finished != "" {
-					resolveState(player, enemy)
+			}
+			updateChans[0] <- updates[0]
+			updateChans[1] <- updates[1]
+			broadcastSpectators(spectators, NewSpectatorUpdate(updates))
+			if paused {
+				rollback.DropInputs()
+				updates = rollback.Updates()
+				clock.Done()
+				continue
+			}
+			for i := 0; i < cycles && !rollback.Over(); i++ {
+				final, err := rollback.Step()
+				if err != nil {
+					logWarn("match", match.ID, "tick", sim.Tick, err)
+				}
+				// Only cycles that can't be redone anymore go in the replay.
+				for _, frame := range final {
+					replay.AddFrame(frame.inputs, frame.updates)
 				}
-				resolveCommand(player, enemy, random)
 			}
-		case input := <-players[0].InputChan:
-			players[0].Command = input.Content
-		case input := <-players[1].InputChan:
-			players[1].Command = input.Content
+			updates = rollback.Updates()
+			clock.Done()
+		case input := <-inputChans[0]:
+			rollback.Input(0, input.Tick, input.Command)
+		case input := <-inputChans[1]:
+			rollback.Input(1, input.Tick, input.Command)
+		case spectator := <-match.Join:
+			spectators[spectator] = true
+		case spectator := <-match.Leave:
+			delete(spectators, spectator)
+			close(spectator)
+		case change := <-match.Connections:
+			if change.Connected {
+				disconnected[change.Player] = time.Time{}
+			} else {
+				disconnected[change.Player] = time.Now()
+			}
+		case <-match.Stop:
+			stopped = true
+		case change := <-trainingChanges:
+			// A rollback can't undo the change, so every cycle before it becomes final first.
+			for _, frame := range rollback.Flush() {
+				replay.AddFrame(frame.inputs, frame.updates)
+			}
+			sim.Training = change.Settings
+			if change.Reset {
+				sim.Reset()
+			}
+			updates = rollback.Updates()
 		}
 	}
+	// The battle hangs around for a while after this to catch stray inputs, but it's no longer in progress as far as the metrics go.
+	clock.Stop()
+	for _, frame := range rollback.Flush() {
+		replay.AddFrame(frame.inputs, frame.updates)
+	}
 	// Send one last update to the players so they know how the battle ended.
-	players[0].UpdateChan <- Update{Self: players[0].Status(), Enemy: players[1].Status()}
-	players[1].UpdateChan <- Update{Self: players[1].Status(), Enemy: players[0].Status()}
+	for p := range updates {
+		updates[p].Over = true
+		updates[p].EnemyForfeited = forfeited[1-p]
+	}
+	updateChans[0] <- updates[0]
+	updateChans[1] <- updates[1]
+	broadcastSpectators(spectators, NewSpectatorUpdate(updates))
+	for spectator := range spectators {
+		close(spectator)
+	}
+	close(match.Done)
+	timing := clock.Stats()
+	logInfo(fmt.Sprintf("match %d ran %d cycles: %d late, %d skipped, %d overruns, %.1fms mean and %.1fms max lag", match.ID,
+		timing.Cycles, timing.Late, timing.Skipped, timing.Overruns, timing.MeanLag, timing.MaxLag))
+	// Training resets the fight whenever the player likes, so there's nothing worth watching again.
+	if match.Training == nil {
+		if err := saveReplay(replay); err != nil {
+			logError("failed to save replay:", err)
+		} else {
+			logInfo("saved replay", replay.ID)
+		}
+	}
 
 	// Make some goroutines to catch the last couple inputs from the players. This is necessary to stop server.go from getting stuck trying to send their input through after the battle is over.
 	stop1 := make(chan bool)
 	stop2 := make(chan bool)
-	go catchInput(players[0].InputChan, stop1)
-	go catchInput(players[1].InputChan, stop2)
+	go catchInput(inputChans[0], stop1)
+	go catchInput(inputChans[1], stop2)
+	// The dispatcher might be busy trying to give us input, so this can't happen until the inputs are being caught.
+	match.Results <- MatchResult{Match: match, Final: updates, Ticks: sim.Tick, Stats: [2]BattleStats{sim.Players[0].Stats, sim.Players[1].Stats}, ReplayID: replay.ID, Forfeited: forfeited, Stopped: stopped, Timing: timing}
 	time.Sleep(5 * time.Second)
 	stop1 <- true
 	stop2 <- true
 }
 
-func resolveState(player *Player, enemy *Player) {
-	switch player.Finished {
-	case "light attack":
-		if enemy.State == "blocking" {
-			if enemy.Stamina >= LIGHT_ATK_BLK_COST {
-				enemy.Stamina -= LIGHT_ATK_BLK_COST
-				// If they haven't been blocking as long as the attack was in progress; that is, if they blocked reactively...
-				if -enemy.StateDuration < LIGHT_ATK_SPD {
-					// The player is counterattacked. They are placed in a stunned state that they must press a button to escape before the counterattack lands.
-					player.SetState("countered", -1)
-					enemy.SetState("counterattack", LIGHT_ATK_CNTR_SPD)
-				}
-			} else {
-				// If you try to block an attack but you don't have enough stamina, you still lose your stamina and you also take damage.
-				enemy.Stamina = 0.0
-				enemy.Life -= LIGHT_ATK_DMG
-			}
-		} else {
-			// If the enemy wasn't blocking, they just take damage.
-			enemy.Life -= LIGHT_ATK_DMG
-		}
-	case "counterattack":
-		// No conditions here because if you dodge the counter attack it puts the enemy out of the counterattacking state.
-		enemy.Life -= LIGHT_ATK_CNTR_DMG
-		enemy.SetState("standing", 0)
-	case "heavy attack":
-		if enemy.State == "blocking" {
-			if enemy.Stamina >= HEAVY_ATK_BLK_COST {
-				enemy.Stamina -= HEAVY_ATK_BLK_COST
-				enemy.Life -= HEAVY_ATK_BLKED_DMG
-			} else {
-				enemy.Stamina = 0.0
-				enemy.Life -= HEAVY_ATK_DMG
+// resolveState applies the effects of the state the player just finished, like an attack landing.
+func resolveState(player *Player, enemy *Player, rules *Rules) error {
+	finished := player.Finished
+	player.Finished = NoState
+	if onFinish := STATES[finished].OnFinish; onFinish != nil {
+		return onFinish(player, enemy, rules)
+	}
+	return nil
+}
+
+func finishLightAttack(player *Player, enemy *Player, rules *Rules) error {
+	if enemy.State == Blocking {
+		if enemy.Stamina >= rules.LightAttackBlockCost {
+			enemy.Stamina -= rules.LightAttackBlockCost
+			enemy.Stats.Blocks++
+			// If they haven't been blocking as long as the attack was in progress; that is, if they blocked reactively...
+			if -enemy.StateDuration < rules.LightAttackSpeed {
+				// The player is counterattacked. They are placed in a stunned state that they must press a button to escape before the counterattack lands.
+				enemy.Stats.Counters++
+				return firstError(player.SetState(Countered, rules), enemy.SetState(Counterattack, rules))
 			}
 		} else {
-			enemy.Life -= HEAVY_ATK_DMG
-			enemy.SetState("standing", 0)
+			// If you try to block an attack but you don't have enough stamina, you still lose your stamina and you also take damage.
+			enemy.Stamina = 0.0
+			player.Hit(enemy, rules.LightAttackDamage)
 		}
+	} else {
+		// If the enemy wasn't blocking, they just take damage.
+		player.Hit(enemy, rules.LightAttackDamage)
 	}
-	player.Finished = ""
+	return nil
+}
 
+func finishCounterattack(player *Player, enemy *Player, rules *Rules) error {
+	// No conditions here because if the enemy saves, it puts us out of the counterattacking state.
+	player.Hit(enemy, rules.CounterattackDamage)
+	return enemy.SetState(Standing, rules)
+}
+
+func finishHeavyAttack(player *Player, enemy *Player, rules *Rules) error {
+	if enemy.State == Blocking {
+		if enemy.Stamina >= rules.HeavyAttackBlockCost {
+			enemy.Stamina -= rules.HeavyAttackBlockCost
+			enemy.Stats.Blocks++
+			player.Hit(enemy, rules.HeavyAttackBlockedDamage)
+		} else {
+			enemy.Stamina = 0.0
+			player.Hit(enemy, rules.HeavyAttackDamage)
+		}
+		return nil
+	}
+	player.Hit(enemy, rules.HeavyAttackDamage)
+	return enemy.SetState(Standing, rules)
 }
 
-func resolveCommand(player *Player, enemy *Player, random *rand.Rand) {
+func resolveCommand(player *Player, enemy *Player, rules *Rules, random *rng) error {
+	var err error
 	switch player.Command {
 	case "NONE":
-		if player.State == "blocking" {
-			player.SetState("standing", 0)
+		if player.State == Blocking {
+			err = player.SetState(Standing, rules)
 		}
 	case "BLOCK":
-		if INTERRUPTABLE_STATES[player.State] && player.State != "blocking" {
-			player.SetState("blocking", 0)
+		if INTERRUPTABLE_STATES[player.State] && player.State != Blocking {
+			err = player.SetState(Blocking, rules)
 		}
 	case "DODGE":
 		// Dodges take time, unlike blocks which can be started at the last possible second.
-		if INTERRUPTABLE_STATES[player.State] && player.Stamina >= DODGE_COST && enemy.StateDuration > DODGE_WINDOW {
-			player.Stamina -= DODGE_COST
+		if INTERRUPTABLE_STATES[player.State] && player.Stamina >= rules.DodgeCost && enemy.StateDuration > rules.DodgeWindow {
+			player.Stamina -= rules.DodgeCost
 			if ATTACK_STATES[enemy.State] {
-				enemy.SetState("standing", 0)
+				err = enemy.SetState(Standing, rules)
+				player.Stats.Dodges++
 			}
 		}
 	case "SAVE":
-		if player.State == "countered" {
-			player.SetState("standing", 0)
-			enemy.SetState("standing", 0)
+		if player.State == Countered {
+			err = firstError(player.SetState(Standing, rules), enemy.SetState(Standing, rules))
 		}
 	case "LIGHT":
-		if INTERRUPTABLE_STATES[player.State] && player.Stamina >= LIGHT_ATK_COST {
-			player.Stamina -= LIGHT_ATK_COST
+		if INTERRUPTABLE_STATES[player.State] && player.Stamina >= rules.LightAttackCost {
+			player.Stamina -= rules.LightAttackCost
 			// If the attack is going to interrupt a heavy attack, enter the interrupt mode.
-			if enemy.State == "heavy attack" && enemy.StateDuration > LIGHT_ATK_SPD {
-				key := INTERRUPT_RESOLVE_KEYS[random.Intn(4)]
-				player.SetState("interrupting heavy"+key, 0)
-				enemy.SetState("interrupted heavy"+key, 0)
-				enemy.Life -= LIGHT_ATK_DMG
+			if enemy.State == HeavyAttack && enemy.StateDuration > rules.LightAttackSpeed {
+				key := random.Intn(4)
+				err = firstError(player.SetState(INTERRUPTING_STATES[key], rules), enemy.SetState(INTERRUPTED_STATES[key], rules))
+				player.Hit(enemy, rules.LightAttackDamage)
 			} else {
-				player.SetState("light attack", LIGHT_ATK_SPD)
+				err = player.SetState(LightAttack, rules)
 			}
 		}
 	case "HEAVY":
-		if INTERRUPTABLE_STATES[player.State] && player.Stamina >= HEAVY_ATK_COST {
-			player.SetState("heavy attack", HEAVY_ATK_SPD)
-			player.Stamina -= HEAVY_ATK_COST
+		if INTERRUPTABLE_STATES[player.State] && player.Stamina >= rules.HeavyAttackCost {
+			err = player.SetState(HeavyAttack, rules)
+			player.Stamina -= rules.HeavyAttackCost
 		}
 	default:
-		if strings.HasPrefix(player.Command, "INTERRUPT_") && strings.HasPrefix(player.State, "interrupt") {
+		state := STATES[player.State]
+		if strings.HasPrefix(player.Command, "INTERRUPT_") && state.Arrow != "" {
 			// Position 10 is just after the '_'.
 			// If we hit the right button:
-			if strings.ToLower(player.Command[10:]) == player.State[strings.Index(player.State, "_")+1:] {
+			if strings.ToLower(player.Command[10:]) == state.Arrow {
+				player.Stats.InterruptsWon++
 				// If we're not the interrupting player, we're the heavy attack player, so the heavy attack hits.
-				if !strings.HasPrefix(player.State, "interrupting") {
-					enemy.Life -= HEAVY_ATK_DMG
+				if !state.Interrupting {
+					player.Hit(enemy, rules.HeavyAttackDamage)
 				}
 			} else {
+				enemy.Stats.InterruptsWon++
 				// Same as above only this time we hit the wrong button, so the condition is reversed - we take damage if we're the interrupting player.
-				if strings.HasPrefix(player.State, "interrupting") {
-					enemy.Life -= HEAVY_ATK_DMG
+				if state.Interrupting {
+					player.Hit(enemy, rules.HeavyAttackDamage)
 				}
 			}
-			player.SetState("standing", 0)
-			enemy.SetState("standing", 0)
+			err = firstError(player.SetState(Standing, rules), enemy.SetState(Standing, rules))
 		}
 	}
 	if player.Command != "BLOCK" {
 		player.Command = "NONE"
 	}
+	return err
 }
 
-func catchInput(channel chan Message, stopChan chan bool) {
+func catchInput(channel chan BattleInput, stopChan chan bool) {
 	for true {
 		select {
 		case <-channel:
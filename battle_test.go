@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// The inputs the random players in these tests pick from. The interrupt inputs are there so that the interrupt arrows, which are
+// random, come into play.
+var TEST_INPUTS = []string{"", "", "", "", "NONE", "BLOCK", "LIGHT", "HEAVY", "DODGE", "SAVE", "INTERRUPT_UP", "INTERRUPT_DOWN", "INTERRUPT_LEFT", "INTERRUPT_RIGHT"}
+
+func newTestSimulation(seed int64) *Simulation {
+	rules := DefaultRules()
+	return NewSimulation(seed, &rules)
+}
+
+// step advances the simulation by one cycle and fails the test if the rules made an illegal state transition.
+func step(t *testing.T, sim *Simulation, inputs [2]string) [2]Update {
+	t.Helper()
+	updates, err := sim.Step(inputs)
+	if err != nil {
+		t.Fatalf("tick %d: %v", sim.Tick, err)
+	}
+	return updates
+}
+
+// wait advances the simulation by some cycles with no new inputs.
+func wait(t *testing.T, sim *Simulation, cycles int) [2]Update {
+	t.Helper()
+	updates := sim.Updates()
+	for i := 0; i < cycles; i++ {
+		updates = step(t, sim, [2]string{})
+	}
+	return updates
+}
+
+func closeTo(a, b float32) bool {
+	return math.Abs(float64(a-b)) < 0.01
+}
+
+func TestSameSeedAndInputsGiveSameUpdates(t *testing.T) {
+	for seed := int64(1); seed <= 20; seed++ {
+		first, second := newTestSimulation(seed), newTestSimulation(seed)
+		random := rand.New(rand.NewSource(seed))
+		for !first.Over() {
+			inputs := [2]string{TEST_INPUTS[random.Intn(len(TEST_INPUTS))], TEST_INPUTS[random.Intn(len(TEST_INPUTS))]}
+			firstUpdates, firstErr := first.Step(inputs)
+			secondUpdates, secondErr := second.Step(inputs)
+			if firstUpdates != secondUpdates || (firstErr == nil) != (secondErr == nil) {
+				t.Fatalf("seed %d diverged at tick %d: %+v and %v, then %+v and %v", seed, first.Tick, firstUpdates, firstErr, secondUpdates, secondErr)
+			}
+		}
+		if !second.Over() || first.Wins != second.Wins {
+			t.Fatalf("seed %d ended differently: %v and %v", seed, first.Wins, second.Wins)
+		}
+	}
+}
+
+func TestLightAttackLandsAfterItsSpeed(t *testing.T) {
+	sim := newTestSimulation(1)
+	rules := sim.Rules
+	updates := step(t, sim, [2]string{"LIGHT", ""})
+	if updates[0].Self.State != LightAttack || !closeTo(updates[0].Self.Stamina, rules.MaxStamina-rules.LightAttackCost) {
+		t.Fatalf("after pressing light attack: %+v", updates[0].Self)
+	}
+	updates = wait(t, sim, rules.LightAttackSpeed-1)
+	if updates[1].Self.Life != rules.StartingLife {
+		t.Fatalf("light attack landed early, life is %d", updates[1].Self.Life)
+	}
+	updates = wait(t, sim, 1)
+	if updates[1].Self.Life != rules.StartingLife-rules.LightAttackDamage || updates[0].Self.State != Standing {
+		t.Fatalf("light attack should have landed: attacker %+v, enemy %+v", updates[0].Self, updates[1].Self)
+	}
+	if sim.Players[0].Stats.DamageDealt != rules.LightAttackDamage {
+		t.Fatalf("damage dealt is %d", sim.Players[0].Stats.DamageDealt)
+	}
+}
+
+func TestBlockingALightAttackCostsStamina(t *testing.T) {
+	sim := newTestSimulation(1)
+	rules := sim.Rules
+	// Blocking well before the attack starts is an ordinary block, not a counter.
+	step(t, sim, [2]string{"", "BLOCK"})
+	wait(t, sim, 10)
+	step(t, sim, [2]string{"LIGHT", ""})
+	updates := wait(t, sim, rules.LightAttackSpeed)
+	blocker := updates[1].Self
+	if blocker.Life != rules.StartingLife || blocker.State != Blocking {
+		t.Fatalf("the block should have stopped the attack: %+v", blocker)
+	}
+	// The blocker regenerates once more after paying for the block, on the same cycle.
+	if !closeTo(blocker.Stamina, rules.MaxStamina-rules.LightAttackBlockCost+rules.StaminaRegen) {
+		t.Fatalf("blocking should cost %v stamina, stamina is %v", rules.LightAttackBlockCost, blocker.Stamina)
+	}
+	if updates[0].Self.State != Standing || sim.Players[1].Stats.Blocks != 1 || sim.Players[1].Stats.Counters != 0 {
+		t.Fatalf("attacker %+v, blocker stats %+v", updates[0].Self, sim.Players[1].Stats)
+	}
+}
+
+func TestReactiveBlockCounters(t *testing.T) {
+	sim := newTestSimulation(1)
+	rules := sim.Rules
+	// Blocking once the attack has started counters it.
+	step(t, sim, [2]string{"LIGHT", "BLOCK"})
+	updates := wait(t, sim, rules.LightAttackSpeed)
+	if updates[0].Self.State != Countered || updates[1].Self.State != Counterattack || sim.Players[1].Stats.Counters != 1 {
+		t.Fatalf("the attack should have been countered: attacker %+v, blocker %+v", updates[0].Self, updates[1].Self)
+	}
+	// Being countered only lasts for that cycle.
+	updates = wait(t, sim, 1)
+	if updates[0].Self.State != Standing {
+		t.Fatalf("countered should end on the next cycle, state is %v", updates[0].Self.State)
+	}
+	updates = wait(t, sim, rules.CounterattackSpeed)
+	if updates[0].Self.Life != rules.StartingLife-rules.CounterattackDamage || updates[1].Self.Life != rules.StartingLife {
+		t.Fatalf("the counterattack should have landed: attacker %+v, blocker %+v", updates[0].Self, updates[1].Self)
+	}
+}
+
+func TestDodgeNeedsTime(t *testing.T) {
+	sim := newTestSimulation(1)
+	rules := sim.Rules
+	step(t, sim, [2]string{"HEAVY", ""})
+	updates := step(t, sim, [2]string{"", "DODGE"})
+	if updates[0].Self.State != Standing || !closeTo(updates[1].Self.Stamina, rules.MaxStamina-rules.DodgeCost) || sim.Players[1].Stats.Dodges != 1 {
+		t.Fatalf("a dodge in time should cancel the heavy attack: attacker %+v, dodger %+v", updates[0].Self, updates[1].Self)
+	}
+
+	sim = newTestSimulation(1)
+	step(t, sim, [2]string{"HEAVY", ""})
+	for sim.Players[0].StateDuration > rules.DodgeWindow {
+		wait(t, sim, 1)
+	}
+	updates = step(t, sim, [2]string{"", "DODGE"})
+	if updates[0].Self.State != HeavyAttack || !closeTo(updates[1].Self.Stamina, rules.MaxStamina) || sim.Players[1].Stats.Dodges != 0 {
+		t.Fatalf("a dodge this late shouldn't happen: attacker %+v, dodger %+v", updates[0].Self, updates[1].Self)
+	}
+	updates = wait(t, sim, sim.Players[0].StateDuration)
+	if updates[1].Self.Life != rules.StartingLife-rules.HeavyAttackDamage {
+		t.Fatalf("the heavy attack should have landed, life is %d", updates[1].Self.Life)
+	}
+}
@@ -0,0 +1,265 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/gorilla/websocket"
+	"math"
+	"net/http"
+)
+
+// The encodings a client can ask for by connecting with ?encoding=<name>. With the binary encoding, updates and spectator updates
+// are sent as binary websocket messages instead of JSON envelopes, and only the fields that changed since the last one are included.
+// Everything else is still JSON. Clients that ask for an encoding the server doesn't know get JSON, and the welcome envelope says
+// which one they got.
+const ENCODING_JSON string = "json"
+const ENCODING_BINARY string = "binary"
+
+// The first byte of every binary frame says what's in it. Each kind is compressed against the last frame of the same kind.
+const (
+	FRAME_UPDATE           byte = 1
+	FRAME_SPECTATOR_UPDATE byte = 2
+)
+
+// After the kind comes a little-endian uint16 with one of these bits set for each field that's included, and then the fields
+// themselves in this order. Life, state durations and every number in an Update are varints (life is signed, since it can go below
+// zero), stamina is a little-endian float32, and a state is a single byte. The welcome envelope lists the name of each state by its
+// number. Spectator updates use the same layout, with player 1 as Self and player 2 as Enemy.
+const (
+	FIELD_SELF_LIFE uint16 = 1 << iota
+	FIELD_SELF_STAMINA
+	FIELD_SELF_STATE
+	FIELD_SELF_DURATION
+	FIELD_ENEMY_LIFE
+	FIELD_ENEMY_STAMINA
+	FIELD_ENEMY_STATE
+	FIELD_ENEMY_DURATION
+	FIELD_TICK
+	FIELD_ACK
+	FIELD_ROUND
+	FIELD_WINS
+	FIELD_ENEMY_WINS
+	FIELD_TIME_LEFT
+	// A single byte of flags. See the FLAG constants.
+	FIELD_FLAGS
+)
+
+const (
+	FLAG_ROUND_OVER byte = 1 << iota
+	FLAG_ENEMY_DISCONNECTED
+	FLAG_OVER
+	FLAG_ENEMY_FORFEITED
+)
+
+var errShortFrame = errors.New("binary frame ended early")
+
+// negotiateEncoding picks the encoding for updates on a new websocket.
+func negotiateEncoding(r *http.Request) string {
+	if r.URL.Query().Get("encoding") == ENCODING_BINARY {
+		return ENCODING_BINARY
+	}
+	return ENCODING_JSON
+}
+
+// An UpdateEncoder turns Updates into binary frames. It remembers the last frame of each kind, so each websocket needs its own.
+type UpdateEncoder struct {
+	last [3]Update
+	sent [3]bool
+}
+
+func flags(update Update) byte {
+	var flags byte
+	set := func(flag byte, on bool) {
+		if on {
+			flags |= flag
+		}
+	}
+	set(FLAG_ROUND_OVER, update.RoundOver)
+	set(FLAG_ENEMY_DISCONNECTED, update.EnemyDisconnected)
+	set(FLAG_OVER, update.Over)
+	set(FLAG_ENEMY_FORFEITED, update.EnemyForfeited)
+	return flags
+}
+
+// Encode makes a frame out of an Update. The first frame of each kind has every field in it.
+func (e *UpdateEncoder) Encode(kind byte, update Update) []byte {
+	last, all := e.last[kind], !e.sent[kind]
+	e.last[kind], e.sent[kind] = update, true
+	frame := make([]byte, 3, 32)
+	frame[0] = kind
+	var mask uint16
+	field := func(bit uint16, changed bool, appendField func()) {
+		if all || changed {
+			mask |= bit
+			appendField()
+		}
+	}
+	appendStatus := func(status, last PlayerStatus, lifeBit, staminaBit, stateBit, durationBit uint16) {
+		field(lifeBit, status.Life != last.Life, func() {
+			frame = binary.AppendVarint(frame, int64(status.Life))
+		})
+		field(staminaBit, status.Stamina != last.Stamina, func() {
+			frame = binary.LittleEndian.AppendUint32(frame, math.Float32bits(status.Stamina))
+		})
+		field(stateBit, status.State != last.State, func() {
+			frame = append(frame, byte(status.State))
+		})
+		field(durationBit, status.StateDuration != last.StateDuration, func() {
+			frame = binary.AppendVarint(frame, int64(status.StateDuration))
+		})
+	}
+	appendNumber := func(bit uint16, number, last int) {
+		field(bit, number != last, func() {
+			frame = binary.AppendVarint(frame, int64(number))
+		})
+	}
+	appendStatus(update.Self, last.Self, FIELD_SELF_LIFE, FIELD_SELF_STAMINA, FIELD_SELF_STATE, FIELD_SELF_DURATION)
+	appendStatus(update.Enemy, last.Enemy, FIELD_ENEMY_LIFE, FIELD_ENEMY_STAMINA, FIELD_ENEMY_STATE, FIELD_ENEMY_DURATION)
+	appendNumber(FIELD_TICK, update.Tick, last.Tick)
+	appendNumber(FIELD_ACK, update.Ack, last.Ack)
+	appendNumber(FIELD_ROUND, update.Round, last.Round)
+	appendNumber(FIELD_WINS, update.Wins, last.Wins)
+	appendNumber(FIELD_ENEMY_WINS, update.EnemyWins, last.EnemyWins)
+	appendNumber(FIELD_TIME_LEFT, update.TimeLeft, last.TimeLeft)
+	field(FIELD_FLAGS, flags(update) != flags(last), func() {
+		frame = append(frame, flags(update))
+	})
+	binary.LittleEndian.PutUint16(frame[1:3], mask)
+	return frame
+}
+
+// An UpdateDecoder reads the frames made by an UpdateEncoder, in the order they were made. The server never reads binary frames; this
+// is the reference for clients that do, and binary_test.go checks that it gets back everything the encoder put in.
+type UpdateDecoder struct {
+	last [3]Update
+}
+
+func (d *UpdateDecoder) Decode(frame []byte) (byte, Update, error) {
+	if len(frame) < 3 {
+		return 0, Update{}, errShortFrame
+	}
+	kind := frame[0]
+	if kind != FRAME_UPDATE && kind != FRAME_SPECTATOR_UPDATE {
+		return 0, Update{}, errors.New("unknown binary frame kind")
+	}
+	mask := binary.LittleEndian.Uint16(frame[1:3])
+	rest := frame[3:]
+	update := d.last[kind]
+	var err error
+	readNumber := func(bit uint16, number *int) {
+		if err != nil || mask&bit == 0 {
+			return
+		}
+		value, n := binary.Varint(rest)
+		if n <= 0 {
+			err = errShortFrame
+			return
+		}
+		*number, rest = int(value), rest[n:]
+	}
+	readStatus := func(status *PlayerStatus, lifeBit, staminaBit, stateBit, durationBit uint16) {
+		readNumber(lifeBit, &status.Life)
+		if err == nil && mask&staminaBit != 0 {
+			if len(rest) < 4 {
+				err = errShortFrame
+				return
+			}
+			status.Stamina, rest = math.Float32frombits(binary.LittleEndian.Uint32(rest)), rest[4:]
+		}
+		if err == nil && mask&stateBit != 0 {
+			if len(rest) < 1 {
+				err = errShortFrame
+				return
+			}
+			status.State, rest = State(rest[0]), rest[1:]
+		}
+		readNumber(durationBit, &status.StateDuration)
+	}
+	readStatus(&update.Self, FIELD_SELF_LIFE, FIELD_SELF_STAMINA, FIELD_SELF_STATE, FIELD_SELF_DURATION)
+	readStatus(&update.Enemy, FIELD_ENEMY_LIFE, FIELD_ENEMY_STAMINA, FIELD_ENEMY_STATE, FIELD_ENEMY_DURATION)
+	readNumber(FIELD_TICK, &update.Tick)
+	readNumber(FIELD_ACK, &update.Ack)
+	readNumber(FIELD_ROUND, &update.Round)
+	readNumber(FIELD_WINS, &update.Wins)
+	readNumber(FIELD_ENEMY_WINS, &update.EnemyWins)
+	readNumber(FIELD_TIME_LEFT, &update.TimeLeft)
+	if err == nil && mask&FIELD_FLAGS != 0 {
+		if len(rest) < 1 {
+			err = errShortFrame
+		} else {
+			flags := rest[0]
+			update.RoundOver = flags&FLAG_ROUND_OVER != 0
+			update.EnemyDisconnected = flags&FLAG_ENEMY_DISCONNECTED != 0
+			update.Over = flags&FLAG_OVER != 0
+			update.EnemyForfeited = flags&FLAG_ENEMY_FORFEITED != 0
+		}
+	}
+	if err != nil {
+		return 0, Update{}, err
+	}
+	d.last[kind] = update
+	return kind, update, nil
+}
+
+// Spectator updates are encoded as Updates, with player 1 as Self and player 2 as Enemy.
+func (u SpectatorUpdate) asUpdate() Update {
+	return Update{Self: u.Player1, Enemy: u.Player2, Round: u.Round, Wins: u.Wins[0], EnemyWins: u.Wins[1], TimeLeft: u.TimeLeft, RoundOver: u.RoundOver, Over: u.Over}
+}
+
+// stateNames lists the name of every state by its number, for binary clients to look them up in.
+func stateNames() []string {
+	names := make([]string, numStates)
+	for state := Standing; state < numStates; state++ {
+		names[state] = STATES[state].Name
+	}
+	return names
+}
+
+// welcome makes the first envelope sent over a new websocket.
+func welcome(version int, encoding string, name string) Envelope {
+	message := Welcome{Version: version, Encoding: encoding, Username: name}
+	if encoding == ENCODING_BINARY {
+		message.States = stateNames()
+	}
+	return NewEnvelope(TYPE_WELCOME, message)
+}
+
+// A socketWriter writes envelopes to a websocket in the encoding its client asked for.
+type socketWriter struct {
+	socket *websocket.Conn
+	// This is nil if the client uses JSON for everything.
+	encoder *UpdateEncoder
+}
+
+func newSocketWriter(socket *websocket.Conn, encoding string) *socketWriter {
+	writer := &socketWriter{socket: socket}
+	if encoding == ENCODING_BINARY {
+		writer.encoder = &UpdateEncoder{}
+	}
+	return writer
+}
+
+func (w *socketWriter) Write(envelope Envelope) error {
+	err := w.write(envelope)
+	if err != nil {
+		WRITE_ERRORS.Inc()
+	}
+	return err
+}
+
+func (w *socketWriter) write(envelope Envelope) error {
+	if w.encoder != nil {
+		switch data := envelope.Data.(type) {
+		case Update:
+			return w.socket.WriteMessage(websocket.BinaryMessage, w.encoder.Encode(FRAME_UPDATE, data))
+		case SpectatorUpdate:
+			return w.socket.WriteMessage(websocket.BinaryMessage, w.encoder.Encode(FRAME_SPECTATOR_UPDATE, data.asUpdate()))
+		}
+	}
+	return w.socket.WriteJSON(envelope)
+}
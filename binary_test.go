@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestBinaryUpdatesDecodeToWhatWasEncoded(t *testing.T) {
+	var encoder UpdateEncoder
+	var decoder UpdateDecoder
+	first := Update{
+		Self:  PlayerStatus{Life: 100, Stamina: 100, State: Standing},
+		Enemy: PlayerStatus{Life: 100, Stamina: 100, State: Standing},
+		Tick:  1, Round: 1, TimeLeft: 8999,
+	}
+	updates := []Update{first}
+	// Each update changes a little from the one before, the way a battle does.
+	next := first
+	next.Tick, next.Ack, next.TimeLeft = 2, 1, 8998
+	next.Self.State, next.Self.StateDuration, next.Self.Stamina = LightAttack, 50, 90.1
+	updates = append(updates, next)
+	// Life can go below zero, and a countered player's duration starts out negative.
+	next.Tick, next.TimeLeft = 300, 8700
+	next.Enemy.Life, next.Self.State, next.Self.StateDuration = -3, Countered, -1
+	next.RoundOver = true
+	updates = append(updates, next)
+	// Big numbers take more than one byte as varints.
+	next.Tick, next.Ack, next.Wins, next.EnemyWins = 1<<20, 1<<20-5, 1, 2
+	next.RoundOver, next.Over, next.EnemyForfeited, next.EnemyDisconnected = false, true, true, true
+	updates = append(updates, next)
+
+	for i, update := range updates {
+		frame := encoder.Encode(FRAME_UPDATE, update)
+		kind, decoded, err := decoder.Decode(frame)
+		if err != nil {
+			t.Fatalf("update %d: %v", i, err)
+		}
+		if kind != FRAME_UPDATE || decoded != update {
+			t.Fatalf("update %d decoded as kind %d %+v, want %+v", i, kind, decoded, update)
+		}
+	}
+}
+
+func TestBinaryFramesOnlyHaveWhatChanged(t *testing.T) {
+	var encoder UpdateEncoder
+	update := Update{Self: PlayerStatus{Life: 100, Stamina: 100, State: Standing}, Enemy: PlayerStatus{Life: 100, Stamina: 100, State: Standing}, Round: 1}
+	frame := encoder.Encode(FRAME_UPDATE, update)
+	if mask := binary.LittleEndian.Uint16(frame[1:3]); mask != 1<<15-1 {
+		t.Fatalf("the first frame should have every field, mask is %b", mask)
+	}
+
+	frame = encoder.Encode(FRAME_UPDATE, update)
+	if len(frame) != 3 || binary.LittleEndian.Uint16(frame[1:3]) != 0 {
+		t.Fatalf("a frame with nothing changed should be empty: %v", frame)
+	}
+
+	update.Tick++
+	update.Enemy.State = HeavyAttack
+	update.Over = true
+	frame = encoder.Encode(FRAME_UPDATE, update)
+	if mask := binary.LittleEndian.Uint16(frame[1:3]); mask != FIELD_ENEMY_STATE|FIELD_TICK|FIELD_FLAGS {
+		t.Fatalf("mask is %b, want %b", mask, FIELD_ENEMY_STATE|FIELD_TICK|FIELD_FLAGS)
+	}
+	// The state and the flags are a byte each, and a tick of 1 is a one byte varint.
+	if len(frame) != 6 || frame[3] != byte(HeavyAttack) || frame[5] != FLAG_OVER {
+		t.Fatalf("frame is %v", frame)
+	}
+
+	// Spectator updates are compressed separately, so the first one is complete too.
+	frame = encoder.Encode(FRAME_SPECTATOR_UPDATE, update)
+	if frame[0] != FRAME_SPECTATOR_UPDATE || binary.LittleEndian.Uint16(frame[1:3]) != 1<<15-1 {
+		t.Fatalf("the first spectator frame should have every field: %v", frame)
+	}
+}
+
+func TestBrokenBinaryFramesAreRejected(t *testing.T) {
+	var encoder UpdateEncoder
+	frame := encoder.Encode(FRAME_UPDATE, Update{Self: PlayerStatus{Life: 100, Stamina: 100, State: Standing}, Tick: 500})
+	for length := 0; length < len(frame); length++ {
+		var decoder UpdateDecoder
+		if _, _, err := decoder.Decode(frame[:length]); err == nil {
+			t.Fatalf("a frame cut off after %d of %d bytes decoded", length, len(frame))
+		}
+	}
+	var decoder UpdateDecoder
+	if _, _, err := decoder.Decode([]byte{9, 0, 0}); err == nil {
+		t.Fatal("a frame of an unknown kind decoded")
+	}
+}
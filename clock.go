@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// When a battle falls behind its schedule, because sending an update blocked or the server was busy, it runs up to this many mainloop
+// cycles back to back each time it wakes up until it has caught up. Each cycle still does exactly the same thing to the game, so
+// stamina and attack timing don't depend on how busy the server is.
+const MAX_CATCH_UP int = 5
+
+// A battle that falls further behind than this many cycles gives up on catching up and starts its schedule over from where it is.
+// The cycles it gave up on are never run, so the battle ends up that much later in real time, but the game itself is the same.
+const MAX_BEHIND int = 50
+
+// TickStats describe how well a battle kept to its schedule. A cycle is late if it started more than a tick interval after it was
+// due, which happens when the battle catches up. An overrun is a wakeup whose work took longer than a tick interval.
+type TickStats struct {
+	Cycles   int     `json:"cycles"`
+	Late     int     `json:"late"`
+	Skipped  int     `json:"skipped"`
+	Overruns int     `json:"overruns"`
+	MaxLag   float64 `json:"maxLagMs"`
+	MeanLag  float64 `json:"meanLagMs"`
+}
+
+// A Clock schedules a battle's mainloop cycles at a fixed timestep, going by how much real time has passed rather than by how many
+// times it has woken up. Every wakeup, the battle asks how many cycles are Due, runs that many, and then says it's Done.
+type Clock struct {
+	// The ID of the match, which labels its metrics.
+	match    int
+	interval time.Duration
+	// When cycle number 0 was due. This moves forward when cycles are skipped.
+	start time.Time
+	// How many cycles have been run, or skipped, since start.
+	cycles int
+	timer  *time.Timer
+	// When the current wakeup started.
+	woke     time.Time
+	stats    TickStats
+	totalLag time.Duration
+	// How late the latest cycle started.
+	lag time.Duration
+}
+
+func NewClock(match int, interval time.Duration) *Clock {
+	now := time.Now()
+	return &Clock{match: match, interval: interval, start: now, timer: time.NewTimer(interval)}
+}
+
+// C receives when it's time to wake up.
+func (c *Clock) C() <-chan time.Time {
+	return c.timer.C
+}
+
+// Due says how many cycles to run now. It's at least 1, since the clock only goes off when a cycle is due.
+func (c *Clock) Due() int {
+	c.woke = time.Now()
+	due := int(c.woke.Sub(c.start)/c.interval) - c.cycles
+	if due < 1 {
+		due = 1
+	}
+	if due > MAX_BEHIND {
+		skipped := due - 1
+		c.stats.Skipped += skipped
+		TICKS_SKIPPED.Add(float64(skipped))
+		logWarn("battle fell", skipped, "ticks behind and skipped them")
+		c.start = c.woke.Add(-time.Duration(c.cycles+1) * c.interval)
+		due = 1
+	}
+	if due > MAX_CATCH_UP {
+		due = MAX_CATCH_UP
+	}
+	for i := 0; i < due; i++ {
+		lag := c.woke.Sub(c.start.Add(time.Duration(c.cycles+1) * c.interval))
+		c.record(lag)
+		c.cycles++
+	}
+	return due
+}
+
+// record notes how long after it was due a cycle started.
+func (c *Clock) record(lag time.Duration) {
+	if lag < 0 {
+		lag = 0
+	}
+	c.stats.Cycles++
+	c.totalLag += lag
+	c.lag = lag
+	if lag > c.interval {
+		c.stats.Late++
+		TICKS_LATE.Inc()
+	}
+	if ms := lag.Seconds() * 1000; ms > c.stats.MaxLag {
+		c.stats.MaxLag = ms
+	}
+	TICK_LAG.Observe(lag.Seconds())
+}
+
+// Done is called once the cycles from Due have been run. It sets the clock to go off when the next one is due, which is right away
+// if the battle is still behind.
+func (c *Clock) Done() {
+	now := time.Now()
+	if now.Sub(c.woke) > c.interval {
+		c.stats.Overruns++
+		TICK_OVERRUNS.Inc()
+	}
+	BATTLE_TICK_LAG.Set(c.match, c.lag.Seconds())
+	BATTLE_TICKS_LATE.Set(c.match, float64(c.stats.Late))
+	BATTLE_TICKS_SKIPPED.Set(c.match, float64(c.stats.Skipped))
+	BATTLE_TICK_OVERRUNS.Set(c.match, float64(c.stats.Overruns))
+	wait := c.start.Add(time.Duration(c.cycles+1) * c.interval).Sub(now)
+	if wait < 0 {
+		wait = 0
+	}
+	c.timer.Reset(wait)
+}
+
+// Stop is called when the battle ends. It also takes the battle out of the per-battle metrics.
+func (c *Clock) Stop() {
+	c.timer.Stop()
+	for _, gauge := range []*battleGauge{BATTLE_TICK_LAG, BATTLE_TICKS_LATE, BATTLE_TICKS_SKIPPED, BATTLE_TICK_OVERRUNS} {
+		gauge.Remove(c.match)
+	}
+}
+
+// Stats returns how well the battle has kept to its schedule so far.
+func (c *Clock) Stats() TickStats {
+	stats := c.stats
+	if stats.Cycles > 0 {
+		stats.MeanLag = c.totalLag.Seconds() * 1000 / float64(stats.Cycles)
+	}
+	return stats
+}
@@ -0,0 +1,294 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The protocol version the bots speak. See the server's protocol.go.
+const PROTOCOL_VERSION int = 2
+
+// How often a bot in a match sends its input, which is the same as the browser.
+const INPUT_INTERVAL time.Duration = 20 * time.Millisecond
+
+// The chance each time a bot playing at random sends an input that it presses something new instead of doing what it was doing.
+const PRESS_CHANCE float64 = 0.1
+
+// After a match, bots wait up to this long before readying up again, like people reading the result.
+const MAX_READY_DELAY time.Duration = time.Second
+
+// What a bot playing at random picks from. NONE is there so that blocks get let go of.
+var RANDOM_INPUTS = []string{"NONE", "BLOCK", "LIGHT", "HEAVY", "DODGE", "SAVE"}
+
+type Envelope struct {
+	Version int         `json:"version"`
+	Type    string      `json:"type"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type Incoming struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type CommandRequest struct {
+	Command string `json:"command"`
+}
+
+type ChatRequest struct {
+	Text string `json:"text"`
+}
+
+type InputRequest struct {
+	Input string `json:"input"`
+	Tick  int    `json:"tick,omitempty"`
+}
+
+// Update only has the parts of the server's Update that the bots use.
+type Update struct {
+	Self struct {
+		State string `json:"state"`
+	} `json:"self"`
+	Tick int  `json:"tick"`
+	Ack  int  `json:"ack"`
+	Over bool `json:"over"`
+}
+
+// Counts are what every bot adds to as it goes, so that they can be reported while the test is running.
+type Counts struct {
+	Connected      int64
+	ConnectFailed  int64
+	Dropped        int64
+	MatchesStarted int64
+	MatchesOver    int64
+	Updates        int64
+	Errors         int64
+}
+
+// A Bot is one simulated player. Only its own goroutine touches it until it's done, after which its latencies are added up.
+type Bot struct {
+	name     string
+	password string
+	base     *url.URL
+	script   []string
+	chat     time.Duration
+	counts   *Counts
+	random   *rand.Rand
+	socket   *websocket.Conn
+	// The input being held, the tick of the newest update, and when the first input tagged with each tick that the server hasn't
+	// acknowledged yet was sent.
+	input      string
+	step       int
+	latestTick int
+	state      string
+	sent       map[int]time.Time
+	inMatch    bool
+	lastUpdate time.Time
+	// How far apart updates arrived during matches, and how long the server took to acknowledge each input.
+	gaps       Latencies
+	roundTrips Latencies
+}
+
+func NewBot(name, password string, base *url.URL, script []string, chat time.Duration, counts *Counts, seed int64) *Bot {
+	return &Bot{name: name, password: password, base: base, script: script, chat: chat, counts: counts,
+		random: rand.New(rand.NewSource(seed)), input: "NONE", sent: make(map[int]time.Time)}
+}
+
+// connect logs the bot in, registering its account the first time, and opens its websocket.
+func (b *Bot) connect() error {
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, Timeout: 30 * time.Second}
+	body, _ := json.Marshal(map[string]string{"username": b.name, "password": b.password})
+	response, err := client.Post(b.base.ResolveReference(&url.URL{Path: "/api/register"}).String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode == http.StatusConflict {
+		response, err = client.Post(b.base.ResolveReference(&url.URL{Path: "/api/login"}).String(), "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+	}
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("couldn't log in as %s: %s %s", b.name, response.Status, strings.TrimSpace(string(message)))
+	}
+	address := *b.base
+	address.Scheme = "ws"
+	if b.base.Scheme == "https" {
+		address.Scheme = "wss"
+	}
+	address.Path = "/ws"
+	address.RawQuery = "version=" + strconv.Itoa(PROTOCOL_VERSION)
+	header := http.Header{}
+	for _, cookie := range jar.Cookies(b.base) {
+		header.Add("Cookie", cookie.String())
+	}
+	b.socket, response, err = websocket.DefaultDialer.Dial(address.String(), header)
+	if err != nil {
+		if response != nil {
+			return fmt.Errorf("%v (%s)", err, response.Status)
+		}
+		return err
+	}
+	return nil
+}
+
+func (b *Bot) send(messageType string, data interface{}) {
+	b.socket.WriteJSON(Envelope{Version: PROTOCOL_VERSION, Type: messageType, Data: data})
+}
+
+// run plays until stop is closed. It readies up, plays whatever match it gets, and readies up again, chatting now and then.
+func (b *Bot) run(stop <-chan bool) {
+	if err := b.connect(); err != nil {
+		atomic.AddInt64(&b.counts.ConnectFailed, 1)
+		logf("%v", err)
+		return
+	}
+	atomic.AddInt64(&b.counts.Connected, 1)
+	defer atomic.AddInt64(&b.counts.Connected, -1)
+	messages := make(chan Incoming)
+	go readMessages(b.socket, messages)
+	inputs := time.NewTicker(INPUT_INTERVAL)
+	defer inputs.Stop()
+	chat := time.NewTimer(b.jitter(b.chat))
+	if b.chat == 0 {
+		chat.Stop()
+	}
+	// This is set after a match, until it's time to ready up again.
+	var ready <-chan time.Time
+	b.send("command", CommandRequest{Command: "READY"})
+	for {
+		select {
+		case <-stop:
+			b.socket.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			b.socket.Close()
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				atomic.AddInt64(&b.counts.Dropped, 1)
+				return
+			}
+			if b.handle(msg) {
+				ready = time.After(time.Duration(b.random.Int63n(int64(MAX_READY_DELAY))))
+			}
+		case <-inputs.C:
+			if b.inMatch {
+				b.sendInput()
+			}
+		case <-chat.C:
+			b.send("chat", ChatRequest{Text: "hello from " + b.name})
+			chat.Reset(b.jitter(b.chat))
+		case <-ready:
+			ready = nil
+			b.send("command", CommandRequest{Command: "READY"})
+		}
+	}
+}
+
+// jitter picks a time from half to one and a half times the given one, so that the bots don't all do things at once.
+func (b *Bot) jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return time.Hour
+	}
+	return d/2 + time.Duration(b.random.Int63n(int64(d)))
+}
+
+// handle acts on a message from the server. It reports whether a match just ended.
+func (b *Bot) handle(msg Incoming) bool {
+	switch msg.Type {
+	case "start_game":
+		atomic.AddInt64(&b.counts.MatchesStarted, 1)
+		b.inMatch = true
+		b.input, b.step, b.latestTick, b.state = "NONE", 0, 0, ""
+		b.lastUpdate = time.Time{}
+		b.sent = make(map[int]time.Time)
+	case "update":
+		if !b.inMatch {
+			return false
+		}
+		var update Update
+		if err := json.Unmarshal(msg.Data, &update); err != nil {
+			return false
+		}
+		now := time.Now()
+		atomic.AddInt64(&b.counts.Updates, 1)
+		if !b.lastUpdate.IsZero() {
+			b.gaps.Add(now.Sub(b.lastUpdate))
+		}
+		b.lastUpdate = now
+		b.latestTick, b.state = update.Tick, update.Self.State
+		for tick, sent := range b.sent {
+			if tick <= update.Ack {
+				b.roundTrips.Add(now.Sub(sent))
+				delete(b.sent, tick)
+			}
+		}
+		if update.Over {
+			atomic.AddInt64(&b.counts.MatchesOver, 1)
+			b.inMatch = false
+			b.send("command", CommandRequest{Command: "END MATCH"})
+			return true
+		}
+	case "error":
+		atomic.AddInt64(&b.counts.Errors, 1)
+	}
+	return false
+}
+
+// sendInput sends the next input from the script, or a random one. Like the browser, everything but a block is only sent once.
+func (b *Bot) sendInput() {
+	if len(b.script) > 0 {
+		b.input = b.script[b.step]
+		b.step = (b.step + 1) % len(b.script)
+	} else if arrow := interruptArrow(b.state); arrow != "" {
+		// The interrupt race is part of the load, since the server has to settle it.
+		b.input = "INTERRUPT_" + strings.ToUpper(arrow)
+	} else if b.random.Float64() < PRESS_CHANCE {
+		b.input = RANDOM_INPUTS[b.random.Intn(len(RANDOM_INPUTS))]
+	}
+	if _, ok := b.sent[b.latestTick]; !ok && b.latestTick > 0 {
+		b.sent[b.latestTick] = time.Now()
+	}
+	b.send("input", InputRequest{Input: b.input, Tick: b.latestTick})
+	if b.input != "BLOCK" {
+		b.input = "NONE"
+	}
+}
+
+// interruptArrow returns the arrow a player in an interrupt has to press, which is the end of the state's name.
+func interruptArrow(state string) string {
+	if !strings.HasPrefix(state, "interrupt") {
+		return ""
+	}
+	return state[strings.LastIndex(state, "_")+1:]
+}
+
+func readMessages(socket *websocket.Conn, messages chan<- Incoming) {
+	defer close(messages)
+	for {
+		var msg Incoming
+		if err := socket.ReadJSON(&msg); err != nil {
+			return
+		}
+		messages <- msg
+	}
+}
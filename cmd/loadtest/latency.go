@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Latencies are counted in buckets this wide, up to this many of them, which covers everything up to 100ms. Longer ones are rare and
+// are the ones worth seeing, so they're kept exactly.
+const LATENCY_BUCKET time.Duration = 100 * time.Microsecond
+const LATENCY_BUCKETS int = 1000
+
+// Latencies is a histogram of durations. Every bot keeps its own so that they don't have to share a lock, and they're merged at the
+// end.
+type Latencies struct {
+	buckets [LATENCY_BUCKETS]uint32
+	long    []time.Duration
+	count   int
+	total   time.Duration
+	max     time.Duration
+}
+
+func (l *Latencies) Add(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	if bucket := int(d / LATENCY_BUCKET); bucket < LATENCY_BUCKETS {
+		l.buckets[bucket]++
+	} else {
+		l.long = append(l.long, d)
+	}
+	l.count++
+	l.total += d
+	if d > l.max {
+		l.max = d
+	}
+}
+
+func (l *Latencies) Merge(other *Latencies) {
+	for i, n := range other.buckets {
+		l.buckets[i] += n
+	}
+	l.long = append(l.long, other.long...)
+	l.count += other.count
+	l.total += other.total
+	if other.max > l.max {
+		l.max = other.max
+	}
+}
+
+// Percentile returns the duration that the given fraction of them are no longer than, to the nearest bucket.
+func (l *Latencies) Percentile(p float64) time.Duration {
+	if l.count == 0 {
+		return 0
+	}
+	rank := int(p * float64(l.count))
+	if rank >= l.count {
+		rank = l.count - 1
+	}
+	seen := 0
+	for i, n := range l.buckets {
+		seen += int(n)
+		if seen > rank {
+			return time.Duration(i+1) * LATENCY_BUCKET
+		}
+	}
+	sort.Slice(l.long, func(i, j int) bool { return l.long[i] < l.long[j] })
+	return l.long[rank-seen]
+}
+
+func (l *Latencies) String() string {
+	if l.count == 0 {
+		return "none measured"
+	}
+	return fmt.Sprintf("mean %v, p50 %v, p99 %v, max %v over %d", (l.total / time.Duration(l.count)).Round(10*time.Microsecond), l.Percentile(0.5), l.Percentile(0.99),
+		l.max.Round(10*time.Microsecond), l.count)
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// loadtest finds out how many players one server can take. It connects simulated players that chat, ready up and play matches with
+// scripted or random inputs at the same rate as the browser, and reports how the server keeps up: how late battle cycles run and how
+// many goroutines it has, from its /metrics, and how far apart updates arrive, how long inputs take to be acknowledged and how many
+// connections drop, from the players' side.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Usernames can't be longer than this. See the server's accounts.go.
+const MAX_USERNAME_LENGTH int = 20
+
+// The battle inputs a script can have.
+var BATTLE_INPUTS = map[string]bool{
+	"NONE": true, "BLOCK": true, "LIGHT": true, "HEAVY": true, "DODGE": true, "SAVE": true,
+	"INTERRUPT_LEFT": true, "INTERRUPT_UP": true, "INTERRUPT_RIGHT": true, "INTERRUPT_DOWN": true,
+}
+
+func logf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+func main() {
+	server := flag.String("server", "http://localhost:8000", "the address of the server")
+	clients := flag.Int("clients", 100, "how many simulated players to connect")
+	ramp := flag.Duration("ramp", 10*time.Second, "how long to take connecting them all")
+	duration := flag.Duration("duration", time.Minute, "how long to keep going once they're all connected")
+	prefix := flag.String("prefix", "loadbot", "the players' accounts are named this followed by a number, and registered if they don't exist")
+	password := flag.String("password", "loadtest-password", "the password of every player's account")
+	script := flag.String("script", "", "inputs each player sends in a loop, one every 20ms, like LIGHT,NONE,NONE,BLOCK; without one they play at random")
+	chat := flag.Duration("chat", 30*time.Second, "about how often each player chats, or 0 for never")
+	report := flag.Duration("report", 5*time.Second, "how often to report progress")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "the seed for the players' random choices")
+	flag.Parse()
+	base, err := url.Parse(*server)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+		log.Fatal("the server has to be an http or https address, like http://localhost:8000")
+	}
+	if *clients < 1 {
+		log.Fatal("there has to be at least one client")
+	}
+	if len(*prefix)+1+len(strconv.Itoa(*clients)) > MAX_USERNAME_LENGTH {
+		log.Fatalf("usernames can't be longer than %d characters, so the prefix is too long", MAX_USERNAME_LENGTH)
+	}
+	var inputs []string
+	if *script != "" {
+		for _, input := range strings.Split(*script, ",") {
+			input = strings.ToUpper(strings.TrimSpace(input))
+			if !BATTLE_INPUTS[input] {
+				log.Fatalf("%q isn't a battle input", input)
+			}
+			inputs = append(inputs, input)
+		}
+	}
+
+	start, err := scrape(base)
+	if err != nil {
+		logf("can't read the server's metrics, so only the players' side will be reported: %v", err)
+	}
+	counts := &Counts{}
+	bots := make([]*Bot, *clients)
+	stop := make(chan bool)
+	var running sync.WaitGroup
+	// Connecting is spread out over the ramp, since logging in is expensive for the server on purpose.
+	ramped := make(chan bool)
+	go func() {
+		defer close(ramped)
+		for i := range bots {
+			bots[i] = NewBot(fmt.Sprintf("%s-%d", *prefix, i+1), *password, base, inputs, *chat, counts, *seed+int64(i))
+			running.Add(1)
+			go func(bot *Bot) {
+				defer running.Done()
+				bot.run(stop)
+			}(bots[i])
+			select {
+			case <-time.After(*ramp / time.Duration(*clients)):
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	began := time.Now()
+	reports := time.NewTicker(*report)
+	defer reports.Stop()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	// The timer for the end only starts once everyone is connected.
+	var end <-chan time.Time
+	waiting := ramped
+	last := start
+	peaks := &Peaks{}
+loop:
+	for {
+		select {
+		case <-waiting:
+			waiting = nil
+			end = time.After(*duration)
+			logf("all %d players have been started", *clients)
+		case <-reports.C:
+			metrics, err := scrape(base)
+			if err != nil {
+				logf("%s: can't read the server's metrics: %v", time.Since(began).Round(time.Second), err)
+				metrics = nil
+			}
+			printProgress(time.Since(began), counts, last, metrics, peaks)
+			if metrics != nil {
+				last = metrics
+			}
+		case <-end:
+			break loop
+		case <-signals:
+			logf("stopping early")
+			break loop
+		}
+	}
+	close(stop)
+	<-ramped
+	running.Wait()
+	final, err := scrape(base)
+	if err != nil {
+		logf("can't read the server's metrics: %v", err)
+	}
+	printSummary(time.Since(began), *clients, counts, bots, start, final, peaks)
+}
+
+// Peaks are the highest the server's gauges were seen at.
+type Peaks struct {
+	Goroutines float64
+	Battles    float64
+}
+
+func (p *Peaks) see(metrics Metrics) {
+	if metrics["go_goroutines"] > p.Goroutines {
+		p.Goroutines = metrics["go_goroutines"]
+	}
+	if metrics["fighting_game_active_battles"] > p.Battles {
+		p.Battles = metrics["fighting_game_active_battles"]
+	}
+}
+
+// printProgress prints a line about how things are going, with the server's numbers since the last report.
+func printProgress(elapsed time.Duration, counts *Counts, last, metrics Metrics, peaks *Peaks) {
+	line := fmt.Sprintf("%6s: %d connected, %d failed to connect, %d dropped, %d matches started", elapsed.Round(time.Second),
+		atomic.LoadInt64(&counts.Connected), atomic.LoadInt64(&counts.ConnectFailed), atomic.LoadInt64(&counts.Dropped),
+		atomic.LoadInt64(&counts.MatchesStarted))
+	if metrics != nil {
+		peaks.see(metrics)
+		line += fmt.Sprintf("; server has %.0f battles and %.0f goroutines, tick lag p99 %s, %.0f late, %.0f skipped, %.0f overruns",
+			metrics["fighting_game_active_battles"], metrics["go_goroutines"], metrics.Quantile(last, "fighting_game_tick_lag_seconds", 0.99),
+			metrics.Since(last, "fighting_game_ticks_late_total"), metrics.Since(last, "fighting_game_ticks_skipped_total"),
+			metrics.Since(last, "fighting_game_tick_overruns_total"))
+	}
+	fmt.Println(line)
+}
+
+// printSummary reports on the whole run once every player has stopped.
+func printSummary(elapsed time.Duration, clients int, counts *Counts, bots []*Bot, start, final Metrics, peaks *Peaks) {
+	var gaps, roundTrips Latencies
+	for _, bot := range bots {
+		if bot != nil {
+			gaps.Merge(&bot.gaps)
+			roundTrips.Merge(&bot.roundTrips)
+		}
+	}
+	fmt.Printf("\nRan %d players for %s.\n", clients, elapsed.Round(time.Second))
+	fmt.Printf("Connections: %d failed to connect, %d dropped by the server.\n", atomic.LoadInt64(&counts.ConnectFailed),
+		atomic.LoadInt64(&counts.Dropped))
+	fmt.Printf("Matches: %d started, %d finished. %d updates received, %d errors.\n", atomic.LoadInt64(&counts.MatchesStarted),
+		atomic.LoadInt64(&counts.MatchesOver), atomic.LoadInt64(&counts.Updates), atomic.LoadInt64(&counts.Errors))
+	fmt.Printf("Time between updates: %s.\n", gaps.String())
+	fmt.Printf("Input round trip, from sending an input until an update acknowledges it: %s.\n", roundTrips.String())
+	if start == nil || final == nil {
+		return
+	}
+	peaks.see(final)
+	cycles := final.Since(start, "fighting_game_tick_lag_seconds_count")
+	lag := 0.0
+	if cycles > 0 {
+		lag = final.Since(start, "fighting_game_tick_lag_seconds_sum") / cycles
+	}
+	fmt.Printf("Server: at most %.0f battles and %.0f goroutines at once. %.0f battle cycles, which started %s late on average, %s for 99%% of them.\n",
+		peaks.Battles, peaks.Goroutines, cycles, formatSeconds(lag), final.Quantile(start, "fighting_game_tick_lag_seconds", 0.99))
+	fmt.Printf("Server: %.0f cycles late, %.0f skipped, %.0f overruns. %.0f slow clients hung up on, %.0f outbound messages dropped or replaced, %.0f write errors.\n",
+		final.Since(start, "fighting_game_ticks_late_total"), final.Since(start, "fighting_game_ticks_skipped_total"),
+		final.Since(start, "fighting_game_tick_overruns_total"), final.Since(start, "fighting_game_slow_clients_total"),
+		final.Since(start, "fighting_game_outbound_dropped_total"), final.Since(start, "fighting_game_websocket_write_errors_total"))
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics are the values from one scrape of the server's /metrics, by series, like `fighting_game_tick_lag_seconds_bucket{le="0.001"}`.
+type Metrics map[string]float64
+
+func scrape(base *url.URL) (Metrics, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Get(base.ResolveReference(&url.URL{Path: "/metrics"}).String())
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("/metrics answered %s", response.Status)
+	}
+	metrics := make(Metrics)
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		space := strings.LastIndex(line, " ")
+		if value, err := strconv.ParseFloat(line[space+1:], 64); err == nil && space > 0 {
+			metrics[line[:space]] = value
+		}
+	}
+	return metrics, scanner.Err()
+}
+
+// Since returns how much a counter went up between an earlier scrape and this one. Counters with labels are added up.
+func (m Metrics) Since(before Metrics, name string) float64 {
+	total := 0.0
+	for series, value := range m {
+		if series == name || strings.HasPrefix(series, name+"{") {
+			total += value - before[series]
+		}
+	}
+	return total
+}
+
+// Quantile estimates a quantile of a histogram from the observations made between an earlier scrape and this one. It returns the
+// upper bound of the bucket the quantile falls in, the same way Prometheus would without interpolating.
+func (m Metrics) Quantile(before Metrics, name string, q float64) string {
+	type bucket struct {
+		bound string
+		le    float64
+		count float64
+	}
+	buckets := make([]bucket, 0)
+	prefix := name + `_bucket{le="`
+	for series, value := range m {
+		if !strings.HasPrefix(series, prefix) {
+			continue
+		}
+		bound := strings.TrimSuffix(strings.TrimPrefix(series, prefix), `"}`)
+		le, err := strconv.ParseFloat(bound, 64)
+		if bound == "+Inf" {
+			le, err = 1e308, nil
+		}
+		if err == nil {
+			buckets = append(buckets, bucket{bound: bound, le: le, count: value - before[series]})
+		}
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].le < buckets[j].le })
+	if len(buckets) == 0 || buckets[len(buckets)-1].count == 0 {
+		return "none observed"
+	}
+	rank := q * buckets[len(buckets)-1].count
+	for _, b := range buckets {
+		if b.count >= rank {
+			if b.bound == "+Inf" {
+				return "over the largest bucket"
+			}
+			return "under " + formatSeconds(b.le)
+		}
+	}
+	return "none observed"
+}
+
+func formatSeconds(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).Round(10 * time.Microsecond).String()
+}
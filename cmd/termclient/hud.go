@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// How many characters wide the HUD's bars are, and how far apart the two players' columns are.
+const BAR_WIDTH int = 30
+const COLUMN_WIDTH int = 50
+
+// How many chat lines the battle screen shows under the HUD, since the lobby's chat scrolls away while it's up.
+const HUD_CHAT_LINES int = 4
+
+// The keys for each battle input. Terminals don't say when a key is let go, so the space bar toggles blocking instead of holding it,
+// and the shift and ctrl keys the browser uses for dodging and saving are d and s.
+var BATTLE_KEYS = map[string]string{
+	"q":       "LIGHT",
+	"w":       "HEAVY",
+	"d":       "DODGE",
+	"s":       "SAVE",
+	KEY_LEFT:  "INTERRUPT_LEFT",
+	KEY_UP:    "INTERRUPT_UP",
+	KEY_RIGHT: "INTERRUPT_RIGHT",
+	KEY_DOWN:  "INTERRUPT_DOWN",
+	"h":       "INTERRUPT_LEFT",
+	"k":       "INTERRUPT_UP",
+	"l":       "INTERRUPT_RIGHT",
+	"j":       "INTERRUPT_DOWN",
+}
+
+const BATTLE_HELP string = "space: block on/off  q: light  w: heavy  d: dodge  s: save  arrows or hjkl: interrupt  /: command"
+
+// A HUD draws the battle screen. Everything is redrawn from the top each time, which is simple and fast enough at the rate the client
+// redraws.
+type HUD struct {
+	out io.Writer
+	// The names on each side. When spectating, the left side is player 1.
+	names [2]string
+	// What's being typed after pressing /, or nil if nothing is.
+	typing   []rune
+	chat     []string
+	training *TrainingStatus
+}
+
+func (h *HUD) addChat(line string) {
+	h.chat = append(h.chat, line)
+	if len(h.chat) > HUD_CHAT_LINES {
+		h.chat = h.chat[len(h.chat)-HUD_CHAT_LINES:]
+	}
+}
+
+// bar draws a value out of 100 as a bar, clamping it to fit.
+func bar(value float64) string {
+	filled := int(value / 100 * float64(BAR_WIDTH))
+	if filled < 0 {
+		filled = 0
+	}
+	if filled > BAR_WIDTH {
+		filled = BAR_WIDTH
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", BAR_WIDTH-filled) + "]"
+}
+
+// arrow returns the arrow a player has to press in an interrupt, which is the end of the state's name, like "interrupting heavy_left".
+func arrow(state string) string {
+	if !strings.HasPrefix(state, "interrupt") {
+		return ""
+	}
+	return state[strings.LastIndex(state, "_")+1:]
+}
+
+// columns lays out one line of the HUD, with the player on the left and the enemy on the right.
+func columns(left, right string) string {
+	return fmt.Sprintf("%-*s%s\r\n", COLUMN_WIDTH, left, right)
+}
+
+// Draw redraws the whole battle screen for an update. input is the command the player is holding.
+func (h *HUD) Draw(update Update, input string, spectating bool) {
+	var screen strings.Builder
+	// Go to the top left corner and clear the screen.
+	screen.WriteString("\x1b[H\x1b[2J")
+	round := fmt.Sprintf("Round %d - %d to %d", update.Round, update.Wins, update.EnemyWins)
+	if update.RoundOver {
+		round += " - round over"
+	} else if update.TimeLeft > 0 {
+		// The time left is in cycles, which are 10ms each.
+		round += fmt.Sprintf(" - %ds left", (update.TimeLeft+99)/100)
+	}
+	screen.WriteString(round + "\r\n\r\n")
+	screen.WriteString(columns(h.names[0], h.names[1]))
+	screen.WriteString(columns("Life    "+bar(float64(update.Self.Life))+fmt.Sprintf(" %3d", update.Self.Life),
+		"Life    "+bar(float64(update.Enemy.Life))+fmt.Sprintf(" %3d", update.Enemy.Life)))
+	screen.WriteString(columns("Stamina "+bar(float64(update.Self.Stamina))+fmt.Sprintf(" %3.0f", update.Self.Stamina),
+		"Stamina "+bar(float64(update.Enemy.Stamina))+fmt.Sprintf(" %3.0f", update.Enemy.Stamina)))
+	screen.WriteString(columns("State   "+bar(float64(update.Self.StateDuration)), "State   "+bar(float64(update.Enemy.StateDuration))))
+	screen.WriteString(columns("        "+update.Self.State, "        "+update.Enemy.State))
+	if update.EnemyDisconnected {
+		screen.WriteString(columns("", "Opponent disconnected, waiting for them to come back..."))
+	}
+	screen.WriteString("\r\n")
+	if direction := arrow(update.Self.State); direction != "" && !spectating {
+		screen.WriteString(fmt.Sprintf("        >>> PRESS %s <<<\r\n", strings.ToUpper(direction)))
+	} else {
+		screen.WriteString("\r\n")
+	}
+	if h.training != nil {
+		screen.WriteString(fmt.Sprintf("Training against %s dummy - infinite life %s, infinite stamina %s\r\n", h.training.Dummy,
+			onOff(h.training.InfiniteLife), onOff(h.training.InfiniteStamina)))
+		if h.training.Recording != "" {
+			screen.WriteString(fmt.Sprintf("Playing recording %s: %s (jitter %d ticks)\r\n", h.training.Recording, h.training.Sequence,
+				h.training.Jitter))
+		}
+	}
+	if spectating {
+		screen.WriteString("Spectating. /stop to stop.\r\n")
+	} else {
+		screen.WriteString(fmt.Sprintf("Holding %s. %s\r\n", input, BATTLE_HELP))
+	}
+	screen.WriteString("\r\n")
+	for _, line := range h.chat {
+		screen.WriteString(line + "\r\n")
+	}
+	if h.typing != nil {
+		screen.WriteString("/" + string(h.typing))
+	}
+	io.WriteString(h.out, screen.String())
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
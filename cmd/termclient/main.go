@@ -0,0 +1,427 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// termclient plays the game in a terminal. It logs in, connects to /ws and speaks the same protocol as the browser, so it also serves
+// as a reference client for the protocol. In the lobby, lines are chat and lines starting with a slash are commands, the same as in
+// the browser. During a battle the terminal shows the HUD and every key counts as soon as it's pressed.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How often the held input is sent during a battle, which is the same as the browser.
+const INPUT_INTERVAL time.Duration = 20 * time.Millisecond
+
+// How often the battle screen is redrawn if anything changed. Terminals can't keep up with an update every cycle.
+const REDRAW_INTERVAL time.Duration = 50 * time.Millisecond
+
+// If the connection drops, the client tries to reconnect this many times, this far apart. The server keeps the session, and the
+// match if there is one, for 30 seconds.
+const RECONNECT_ATTEMPTS int = 30
+const RECONNECT_DELAY time.Duration = time.Second
+
+// The password is read from this environment variable if it's set, so scripts don't have to type it.
+const PASSWORD_ENV string = "FIGHTING_GAME_PASSWORD"
+
+// A Client is everything the client keeps track of. Only the main loop uses it.
+type Client struct {
+	base     *url.URL
+	http     *http.Client
+	terminal *Terminal
+	hud      *HUD
+	socket   *websocket.Conn
+	messages chan Incoming
+	// The session the server gave us, which lets us pick up where we left off if the connection drops.
+	session  string
+	username string
+	// What's been typed in the lobby since the last Enter.
+	line []rune
+	// Whether the battle screen is up, and whether we're only watching.
+	inBattle   bool
+	spectating bool
+	// The input we're holding, and the tick of the newest update, which inputs are tagged with.
+	input      string
+	latestTick int
+	latest     Update
+	dirty      bool
+	quit       bool
+}
+
+func main() {
+	server := flag.String("server", "http://localhost:8000", "the address of the server")
+	username := flag.String("user", "", "the account to log in to; you're asked for it if it isn't given")
+	register := flag.Bool("register", false, "register the account before logging in to it")
+	flag.Parse()
+	base, err := url.Parse(*server)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+		log.Fatal("the server has to be an http or https address, like http://localhost:8000")
+	}
+	stdin := bufio.NewReader(os.Stdin)
+	terminal := NewTerminal()
+	name := *username
+	for name == "" {
+		fmt.Print("Username: ")
+		line, err := stdin.ReadString('\n')
+		if err != nil {
+			return
+		}
+		name = strings.TrimSpace(line)
+	}
+	password := os.Getenv(PASSWORD_ENV)
+	if password == "" {
+		if password, err = terminal.ReadPassword(stdin, "Password: "); err != nil {
+			return
+		}
+	}
+	jar, _ := cookiejar.New(nil)
+	client := &Client{base: base, http: &http.Client{Jar: jar}, terminal: terminal, hud: &HUD{out: os.Stdout}, username: name}
+	if err := client.login(name, password, *register); err != nil {
+		log.Fatal("couldn't log in: ", err)
+	}
+	if err := client.connect(); err != nil {
+		log.Fatal("couldn't connect: ", err)
+	}
+	defer terminal.Restore()
+	fmt.Println("Connected. Type to chat, /ready to find a match, /help for the other commands, and /quit to leave.")
+	client.run(stdin)
+}
+
+// login logs in, or registers first, which sets the login cookie in the client's cookie jar.
+func (c *Client) login(username, password string, register bool) error {
+	path := "/api/login"
+	if register {
+		path = "/api/register"
+	}
+	body, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		return err
+	}
+	response, err := c.http.Post(c.base.ResolveReference(&url.URL{Path: path}).String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(response.Body)
+		return errors.New(strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// connect opens the websocket, resuming our session if we have one, and starts reading from it.
+func (c *Client) connect() error {
+	address := *c.base
+	address.Scheme = "ws"
+	if c.base.Scheme == "https" {
+		address.Scheme = "wss"
+	}
+	address.Path = "/ws"
+	query := url.Values{"version": {strconv.Itoa(PROTOCOL_VERSION)}}
+	if c.session != "" {
+		query.Set("session", c.session)
+	}
+	address.RawQuery = query.Encode()
+	header := http.Header{}
+	for _, cookie := range c.http.Jar.Cookies(c.base) {
+		header.Add("Cookie", cookie.String())
+	}
+	socket, response, err := websocket.DefaultDialer.Dial(address.String(), header)
+	if err != nil {
+		if response != nil {
+			return fmt.Errorf("%v (%s)", err, response.Status)
+		}
+		return err
+	}
+	c.socket = socket
+	c.messages = make(chan Incoming)
+	go readMessages(socket, c.messages)
+	return nil
+}
+
+// readMessages passes along everything the server sends until the websocket closes, and then closes messages.
+func readMessages(socket *websocket.Conn, messages chan<- Incoming) {
+	defer close(messages)
+	for {
+		var msg Incoming
+		if err := socket.ReadJSON(&msg); err != nil {
+			return
+		}
+		messages <- msg
+	}
+}
+
+// reconnect tries to get the websocket back after it dropped. It reports whether it did.
+func (c *Client) reconnect() bool {
+	c.show("server", "The connection dropped. Reconnecting...")
+	for attempt := 0; attempt < RECONNECT_ATTEMPTS; attempt++ {
+		time.Sleep(RECONNECT_DELAY)
+		if err := c.connect(); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) send(messageType string, data interface{}) {
+	if err := c.socket.WriteJSON(Envelope{Version: PROTOCOL_VERSION, Type: messageType, Data: data}); err != nil {
+		// The reader notices too, and reconnects.
+		c.socket.Close()
+	}
+}
+
+func (c *Client) run(stdin *bufio.Reader) {
+	keys := make(chan string)
+	go readKeys(stdin, keys)
+	inputs := time.NewTicker(INPUT_INTERVAL)
+	defer inputs.Stop()
+	redraws := time.NewTicker(REDRAW_INTERVAL)
+	defer redraws.Stop()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	for !c.quit {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				// If we were in a match, the server resumes it once we're back.
+				c.endBattle()
+				if !c.reconnect() {
+					fmt.Println("Couldn't reconnect.")
+					return
+				}
+				continue
+			}
+			c.handle(msg)
+		case key, ok := <-keys:
+			if !ok {
+				return
+			}
+			c.key(key)
+		case <-inputs.C:
+			if c.inBattle && !c.spectating {
+				c.send("input", InputRequest{Input: c.input, Tick: c.latestTick})
+				// Everything but a block is a single press.
+				if c.input != "BLOCK" {
+					c.input = "NONE"
+				}
+			}
+		case <-redraws.C:
+			if c.inBattle && c.dirty {
+				c.hud.Draw(c.latest, c.input, c.spectating)
+				c.dirty = false
+			}
+		case <-signals:
+			c.endBattle()
+			return
+		}
+	}
+	c.socket.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// handle acts on a message from the server.
+func (c *Client) handle(msg Incoming) {
+	switch msg.Type {
+	case "welcome":
+		var welcome Welcome
+		json.Unmarshal(msg.Data, &welcome)
+		c.username = welcome.Username
+	case "session":
+		var session Session
+		json.Unmarshal(msg.Data, &session)
+		c.session = session.Token
+	case "chat":
+		var chat Chat
+		json.Unmarshal(msg.Data, &chat)
+		c.show(chat.From, chat.Text)
+	case "error":
+		var protocolError ProtocolError
+		json.Unmarshal(msg.Data, &protocolError)
+		c.show("error", protocolError.Message)
+		if protocolError.Code == "unsupported_version" {
+			c.quit = true
+		}
+	case "start_game", "resume_game":
+		if !c.inBattle {
+			c.startBattle(false, [2]string{c.username, "opponent"})
+		}
+	case "start_spectating":
+		c.startBattle(true, [2]string{"player 1", "player 2"})
+	case "update":
+		var update Update
+		json.Unmarshal(msg.Data, &update)
+		c.battleUpdate(update)
+	case "spectator_update":
+		var update SpectatorUpdate
+		json.Unmarshal(msg.Data, &update)
+		c.battleUpdate(update.Update())
+	case "training":
+		var status TrainingStatus
+		json.Unmarshal(msg.Data, &status)
+		c.hud.training = &status
+		c.dirty = true
+	}
+}
+
+// show prints a chat line, or adds it to the battle screen.
+func (c *Client) show(from, text string) {
+	line := "[" + from + "] " + text
+	if c.inBattle {
+		c.hud.addChat(line)
+		c.dirty = true
+		return
+	}
+	fmt.Println(line)
+}
+
+func (c *Client) startBattle(spectating bool, names [2]string) {
+	c.inBattle, c.spectating = true, spectating
+	c.input, c.latestTick = "NONE", 0
+	c.hud.names = names
+	c.hud.chat = nil
+	c.terminal.Raw()
+}
+
+func (c *Client) battleUpdate(update Update) {
+	if !c.inBattle {
+		return
+	}
+	c.latest, c.latestTick, c.dirty = update, update.Tick, true
+	if !update.Over {
+		return
+	}
+	c.hud.Draw(update, c.input, c.spectating)
+	result := fmt.Sprintf("Result of battle: you won %d of %d rounds and the enemy won %d. In the last round, you had %d life and the enemy had %d.",
+		update.Wins, update.Round, update.EnemyWins, update.Self.Life, update.Enemy.Life)
+	if c.hud.training != nil {
+		result = "Training is over."
+	} else if c.spectating {
+		result = fmt.Sprintf("Result of battle: player 1 won %d of %d rounds and player 2 won %d.", update.Wins, update.Round, update.EnemyWins)
+	} else if update.EnemyForfeited {
+		result = "You win! Your opponent didn't reconnect in time."
+	}
+	if c.spectating {
+		c.send("command", CommandRequest{Command: "STOP SPECTATING"})
+	} else {
+		c.send("command", CommandRequest{Command: "END MATCH"})
+	}
+	c.endBattle()
+	c.show("server", result)
+}
+
+// endBattle takes down the battle screen.
+func (c *Client) endBattle() {
+	if !c.inBattle {
+		return
+	}
+	c.inBattle, c.spectating = false, false
+	c.hud.typing, c.hud.training = nil, nil
+	c.terminal.Restore()
+	fmt.Print("\r\n")
+}
+
+// key acts on a key press. In the lobby keys are collected into lines. During a battle they're inputs, unless a command is being typed.
+func (c *Client) key(key string) {
+	if !c.inBattle {
+		if key == "\n" {
+			line := string(c.line)
+			c.line = c.line[:0]
+			c.submit(line)
+		} else if key != "\r" {
+			c.line = append(c.line, []rune(key)...)
+		}
+		return
+	}
+	c.dirty = true
+	if c.hud.typing != nil {
+		switch key {
+		case "\n", "\r":
+			line := "/" + string(c.hud.typing)
+			c.hud.typing = nil
+			c.submit(line)
+		case KEY_ESC:
+			c.hud.typing = nil
+		case "\x7f", "\b":
+			if len(c.hud.typing) > 0 {
+				c.hud.typing = c.hud.typing[:len(c.hud.typing)-1]
+			}
+		default:
+			if len([]rune(key)) == 1 {
+				c.hud.typing = append(c.hud.typing, []rune(key)...)
+			}
+		}
+		return
+	}
+	switch {
+	case key == "/":
+		c.hud.typing = []rune{}
+	case c.spectating:
+		// Spectators have nothing to press.
+	case key == " ":
+		if c.input == "BLOCK" {
+			c.input = "NONE"
+		} else {
+			c.input = "BLOCK"
+		}
+	case BATTLE_KEYS[key] != "":
+		c.input = BATTLE_KEYS[key]
+	}
+}
+
+// submit sends a line that was typed, which is a command if it starts with a slash and chat otherwise.
+func (c *Client) submit(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	if !strings.HasPrefix(line, "/") {
+		c.send("chat", ChatRequest{Text: line})
+		return
+	}
+	words := strings.Fields(line[1:])
+	if len(words) == 0 {
+		return
+	}
+	switch words[0] {
+	case "quit":
+		c.quit = true
+		return
+	case "help":
+		names := make([]string, 0, len(SLASH_COMMANDS))
+		for name := range SLASH_COMMANDS {
+			names = append(names, "/"+name)
+		}
+		sort.Strings(names)
+		c.show("help", "Commands: "+strings.Join(names, " ")+" /quit")
+		return
+	}
+	command, ok := SLASH_COMMANDS[words[0]]
+	if !ok {
+		c.show("error", "Unknown command: /"+words[0])
+		return
+	}
+	c.send("command", CommandRequest{Command: command, Argument: strings.Join(words[1:], " ")})
+	// The server doesn't send anything else to a spectator who stops watching.
+	if command == "STOP SPECTATING" && c.spectating {
+		c.endBattle()
+	}
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"encoding/json"
+)
+
+// The protocol version this client speaks. The server's protocol.go describes the protocol, and these types mirror the ones there
+// that the client needs, since the server is a main package and can't be imported.
+const PROTOCOL_VERSION int = 2
+
+// Envelope is what the client sends. Data is one of the request types below.
+type Envelope struct {
+	Version int         `json:"version"`
+	Type    string      `json:"type"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// Incoming is what the server sends. Data is decoded once Type says what it is.
+type Incoming struct {
+	Version int             `json:"version"`
+	Type    string          `json:"type"`
+	Data    json.RawMessage `json:"data"`
+}
+
+type ChatRequest struct {
+	Text string `json:"text"`
+}
+
+type CommandRequest struct {
+	Command  string `json:"command"`
+	Argument string `json:"argument,omitempty"`
+}
+
+type InputRequest struct {
+	Input string `json:"input"`
+	Tick  int    `json:"tick,omitempty"`
+}
+
+type Chat struct {
+	From string `json:"from"`
+	Text string `json:"text"`
+}
+
+type Welcome struct {
+	Version  int    `json:"version"`
+	Encoding string `json:"encoding"`
+	Username string `json:"username"`
+}
+
+type Session struct {
+	Token string `json:"token"`
+}
+
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PlayerStatus is what the HUD shows for each player. StateDuration is how many mainloop cycles they have left in their state, which
+// the HUD draws as a bar that's full at 100, the length of a heavy attack under the default rules.
+type PlayerStatus struct {
+	Life          int     `json:"life"`
+	Stamina       float32 `json:"stamina"`
+	State         string  `json:"state"`
+	StateDuration int     `json:"stateDur"`
+}
+
+type Update struct {
+	Self              PlayerStatus `json:"self"`
+	Enemy             PlayerStatus `json:"enemy"`
+	Tick              int          `json:"tick"`
+	Round             int          `json:"round"`
+	Wins              int          `json:"wins"`
+	EnemyWins         int          `json:"enemyWins"`
+	TimeLeft          int          `json:"timeLeft"`
+	RoundOver         bool         `json:"roundOver"`
+	EnemyDisconnected bool         `json:"enemyDisconnected"`
+	Over              bool         `json:"over"`
+	EnemyForfeited    bool         `json:"enemyForfeited"`
+}
+
+type SpectatorUpdate struct {
+	Player1   PlayerStatus `json:"player1"`
+	Player2   PlayerStatus `json:"player2"`
+	Round     int          `json:"round"`
+	Wins      [2]int       `json:"wins"`
+	TimeLeft  int          `json:"timeLeft"`
+	RoundOver bool         `json:"roundOver"`
+	Over      bool         `json:"over"`
+}
+
+// Update turns a SpectatorUpdate into an Update from player 1's point of view, so the HUD can draw both the same way.
+func (s SpectatorUpdate) Update() Update {
+	return Update{Self: s.Player1, Enemy: s.Player2, Round: s.Round, Wins: s.Wins[0], EnemyWins: s.Wins[1], TimeLeft: s.TimeLeft,
+		RoundOver: s.RoundOver, Over: s.Over}
+}
+
+type TrainingStatus struct {
+	Dummy           string `json:"dummy"`
+	Recording       string `json:"recording"`
+	Sequence        string `json:"sequence"`
+	Jitter          int    `json:"jitter"`
+	InfiniteLife    bool   `json:"infiniteLife"`
+	InfiniteStamina bool   `json:"infiniteStamina"`
+}
+
+// The slash commands the client understands, and the lobby commands they send. They're the same ones the browser has, plus ready and
+// unready, which the browser has a button for.
+var SLASH_COMMANDS = map[string]string{
+	"ready":      "READY",
+	"unready":    "UNREADY",
+	"matches":    "LIST MATCHES",
+	"spectate":   "SPECTATE",
+	"stop":       "STOP SPECTATING",
+	"ratings":    "RATINGS",
+	"rules":      "LIST RULES",
+	"setrules":   "SET RULES",
+	"rooms":      "LIST ROOMS",
+	"create":     "CREATE ROOM",
+	"join":       "JOIN ROOM",
+	"leave":      "LEAVE ROOM",
+	"invite":     "INVITE",
+	"challenge":  "CHALLENGE",
+	"accept":     "ACCEPT",
+	"decline":    "DECLINE",
+	"practice":   "PRACTICE",
+	"training":   "TRAINING",
+	"dummy":      "DUMMY",
+	"life":       "INFINITE LIFE",
+	"stamina":    "INFINITE STAMINA",
+	"reset":      "RESET",
+	"end":        "END TRAINING",
+	"record":     "RECORD",
+	"playback":   "PLAYBACK",
+	"jitter":     "JITTER",
+	"recordings": "RECORDINGS",
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// The terminal is switched with stty rather than a terminal library, so the client has no dependencies besides the websocket one the
+// server already vendors. In the lobby it's left alone, so lines are typed and edited as usual. During a battle every key has to
+// count the moment it's pressed, so the terminal is put in cbreak mode without echo. Ctrl-C still works in cbreak mode.
+type Terminal struct {
+	// The settings the terminal had when the client started, from stty -g, or empty if stdin isn't a terminal.
+	saved string
+	raw   bool
+}
+
+func NewTerminal() *Terminal {
+	saved, err := stty("-g")
+	if err != nil {
+		return &Terminal{}
+	}
+	return &Terminal{saved: strings.TrimSpace(saved)}
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	output, err := cmd.Output()
+	return string(output), err
+}
+
+// Raw makes every key press available right away. Without a terminal, keys only arrive once Enter is pressed, which still works for
+// testing.
+func (t *Terminal) Raw() {
+	if t.saved == "" || t.raw {
+		return
+	}
+	if _, err := stty("cbreak", "-echo"); err == nil {
+		t.raw = true
+	}
+}
+
+// Restore puts the terminal back the way it was.
+func (t *Terminal) Restore() {
+	if t.saved == "" || !t.raw {
+		return
+	}
+	stty(t.saved)
+	t.raw = false
+}
+
+// ReadPassword reads a line without echoing it.
+func (t *Terminal) ReadPassword(reader *bufio.Reader, prompt string) (string, error) {
+	fmt.Print(prompt)
+	if t.saved != "" {
+		stty("-echo")
+		defer stty(t.saved)
+		defer fmt.Println()
+	}
+	line, err := reader.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// These are the keys readKeys reports for the arrow keys, which the terminal sends as escape sequences.
+const (
+	KEY_UP    = "up"
+	KEY_DOWN  = "down"
+	KEY_RIGHT = "right"
+	KEY_LEFT  = "left"
+	KEY_ESC   = "esc"
+)
+
+var ARROW_KEYS = map[byte]string{'A': KEY_UP, 'B': KEY_DOWN, 'C': KEY_RIGHT, 'D': KEY_LEFT}
+
+// readKeys reads stdin and sends each key through keys, as the character it typed or one of the KEY constants. It closes keys when
+// stdin runs out. In the lobby the terminal isn't raw, so keys come a line at a time, which the client puts back together.
+func readKeys(reader *bufio.Reader, keys chan<- string) {
+	defer close(keys)
+	for {
+		char, _, err := reader.ReadRune()
+		if err != nil {
+			return
+		}
+		if char != 0x1b {
+			keys <- string(char)
+			continue
+		}
+		// An arrow key is ESC [ and a letter. The rest of the sequence is already waiting if it's there at all, so a lone ESC doesn't
+		// hold anything up.
+		if reader.Buffered() >= 2 {
+			if next, _ := reader.Peek(2); next[0] == '[' {
+				reader.Discard(2)
+				if arrow, ok := ARROW_KEYS[next[1]]; ok {
+					keys <- arrow
+				}
+				continue
+			}
+		}
+		keys <- KEY_ESC
+	}
+}
@@ -0,0 +1,333 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables for the settings are this followed by the setting's name in capitals, with dashes turned into underscores,
+// like FIGHTING_GAME_TICK_INTERVAL.
+const CONFIG_ENV_PREFIX string = "FIGHTING_GAME_"
+
+// Config holds the server's settings. Each one comes from the first of these that has it: a command line flag, an environment
+// variable, the config file, or the default. See CONFIG_OPTIONS for what each setting means.
+type Config struct {
+	Listen          string
+	StaticDir       string
+	TickInterval    time.Duration
+	AllowedOrigins  []string
+	TLSCert         string
+	TLSKey          string
+	LogLevel        LogLevel
+	DataDir         string
+	ShutdownTimeout time.Duration
+	Outbound        OutboundPolicy
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Listen:          ":8000",
+		StaticDir:       "static",
+		TickInterval:    10 * time.Millisecond,
+		LogLevel:        LOG_INFO,
+		DataDir:         ".",
+		ShutdownTimeout: 5 * time.Minute,
+		Outbound:        OutboundPolicy{MaxChat: 100, SlowClientTimeout: 10 * time.Second},
+	}
+}
+
+// A configOption is one setting. Its name is used for the flag, the environment variable and the key in the config file, and set
+// parses a value for it from any of them.
+type configOption struct {
+	name  string
+	usage string
+	set   func(config *Config, value string) error
+}
+
+var CONFIG_OPTIONS = []configOption{
+	{"listen", "the address to serve on, like :8000 or 127.0.0.1:443", func(c *Config, value string) error {
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			return err
+		}
+		c.Listen = value
+		return nil
+	}},
+	{"static-dir", "the directory the web client is served from", func(c *Config, value string) error {
+		c.StaticDir = value
+		return nil
+	}},
+	{"tick-interval", "how long each mainloop cycle of a battle takes, like 10ms; the rules assume 10ms", func(c *Config, value string) error {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		c.TickInterval = interval
+		return nil
+	}},
+	{"allowed-origins", "comma separated origins, like https://example.com, whose pages may open websockets besides the server's own; * allows any", func(c *Config, value string) error {
+		c.AllowedOrigins = nil
+		for _, origin := range strings.Split(value, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				c.AllowedOrigins = append(c.AllowedOrigins, origin)
+			}
+		}
+		return nil
+	}},
+	{"tls-cert", "the TLS certificate file; serves HTTPS if set along with tls-key", func(c *Config, value string) error {
+		c.TLSCert = value
+		return nil
+	}},
+	{"tls-key", "the TLS private key file", func(c *Config, value string) error {
+		c.TLSKey = value
+		return nil
+	}},
+	{"log-level", "the least important messages to log: debug, info, warn or error", func(c *Config, value string) error {
+		level, ok := LOG_LEVELS[value]
+		if !ok {
+			return fmt.Errorf("unknown log level %q", value)
+		}
+		c.LogLevel = level
+		return nil
+	}},
+	{"data-dir", "the directory accounts, match history and replays are kept in", func(c *Config, value string) error {
+		c.DataDir = value
+		return nil
+	}},
+	{"shutdown-timeout", "how long matches in progress get to finish when the server is told to stop, like 5m, before they're called a draw", func(c *Config, value string) error {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		c.ShutdownTimeout = timeout
+		return nil
+	}},
+	{"chat-backlog", "how many chat messages can wait for a client that's behind before the oldest are dropped", func(c *Config, value string) error {
+		backlog, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		c.Outbound.MaxChat = backlog
+		return nil
+	}},
+	{"slow-client-timeout", "how long a client can go without taking any of the messages waiting for it before it's hung up on, like 10s", func(c *Config, value string) error {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		c.Outbound.SlowClientTimeout = timeout
+		return nil
+	}},
+}
+
+func (o configOption) env() string {
+	return CONFIG_ENV_PREFIX + strings.ToUpper(strings.Replace(o.name, "-", "_", -1))
+}
+
+// LoadConfig works out the settings from the command line arguments, the environment and the config file. The config file is named by
+// the -config flag or the FIGHTING_GAME_CONFIG environment variable, and there isn't one unless it's named. It's a JSON object with a
+// key for each setting it changes; allowed-origins can be a list or a comma separated string, and everything else is a string.
+func LoadConfig(args []string) (Config, error) {
+	config := DefaultConfig()
+	flags := flag.NewFlagSet("fighting-game", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv(CONFIG_ENV_PREFIX+"CONFIG"), "a JSON file to read settings from")
+	// Flags are only collected here, since they have to be applied last.
+	flagValues := make(map[string]string)
+	for _, option := range CONFIG_OPTIONS {
+		name := option.name
+		flags.Func(name, option.usage+" (or $"+option.env()+")", func(value string) error {
+			flagValues[name] = value
+			return nil
+		})
+	}
+	if err := flags.Parse(args); err != nil {
+		return config, err
+	}
+	if flags.NArg() > 0 {
+		return config, fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	problems := make([]string, 0)
+	set := func(option configOption, value, source string) {
+		if err := option.set(&config, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s from %s: %v", option.name, source, err))
+		}
+	}
+	if *configPath != "" {
+		fileValues, err := readConfigFile(*configPath)
+		if err != nil {
+			return config, err
+		}
+		for _, option := range CONFIG_OPTIONS {
+			if value, ok := fileValues[option.name]; ok {
+				set(option, value, *configPath)
+			}
+		}
+	}
+	for _, option := range CONFIG_OPTIONS {
+		if value, ok := os.LookupEnv(option.env()); ok {
+			set(option, value, "$"+option.env())
+		}
+	}
+	for _, option := range CONFIG_OPTIONS {
+		if value, ok := flagValues[option.name]; ok {
+			set(option, value, "-"+option.name)
+		}
+	}
+	problems = append(problems, config.problems()...)
+	if len(problems) > 0 {
+		return config, fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return config, nil
+}
+
+// readConfigFile reads the settings in a config file as strings, as if they had been given as flags.
+func readConfigFile(path string) (map[string]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(contents, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	known := make(map[string]bool)
+	for _, option := range CONFIG_OPTIONS {
+		known[option.name] = true
+	}
+	values := make(map[string]string)
+	for name, value := range raw {
+		if !known[name] {
+			return nil, fmt.Errorf("%s: there is no setting called %q", path, name)
+		}
+		var text string
+		var list []string
+		if err := json.Unmarshal(value, &text); err == nil {
+			values[name] = text
+		} else if err := json.Unmarshal(value, &list); err == nil && name == "allowed-origins" {
+			values[name] = strings.Join(list, ",")
+		} else {
+			return nil, fmt.Errorf("%s: %s must be a string", path, name)
+		}
+	}
+	return values, nil
+}
+
+// problems checks that the settings can work together and with the files they name.
+func (c *Config) problems() []string {
+	problems := make([]string, 0)
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+	if info, err := os.Stat(c.StaticDir); err != nil {
+		problems = append(problems, "static-dir: "+err.Error())
+	} else {
+		check(info.IsDir(), "static-dir: "+c.StaticDir+" is not a directory")
+	}
+	check(c.TickInterval >= time.Millisecond && c.TickInterval <= time.Second, "tick-interval must be between 1ms and 1s")
+	for _, origin := range c.AllowedOrigins {
+		parsed, err := url.Parse(origin)
+		check(origin == "*" || (err == nil && parsed.Scheme != "" && parsed.Host != "" && parsed.Path == ""),
+			"allowed-origins: "+origin+" should look like https://example.com")
+	}
+	check(c.ShutdownTimeout >= 0, "shutdown-timeout can't be negative")
+	check(c.Outbound.MaxChat > 0, "chat-backlog must be at least 1")
+	check(c.Outbound.SlowClientTimeout >= time.Second, "slow-client-timeout must be at least 1s")
+	check((c.TLSCert == "") == (c.TLSKey == ""), "tls-cert and tls-key have to be set together")
+	for _, path := range []string{c.TLSCert, c.TLSKey} {
+		if path != "" {
+			if _, err := os.Stat(path); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+	if err := os.MkdirAll(c.DataDir, 0755); err != nil {
+		problems = append(problems, "data-dir: "+err.Error())
+	}
+	return problems
+}
+
+// Apply puts the settings that live in package variables into effect. It has to be called before the server starts.
+func (c *Config) Apply() {
+	LOG_LEVEL = c.LogLevel
+	TICK_INTERVAL = c.TickInterval
+	OUTBOUND_POLICY = c.Outbound
+	MATCH_STORE_PATH = filepath.Join(c.DataDir, "matches.jsonl")
+	ACCOUNT_STORE_PATH = filepath.Join(c.DataDir, "accounts.jsonl")
+	RECORDING_STORE_PATH = filepath.Join(c.DataDir, "recordings.jsonl")
+	REPLAY_DIR = filepath.Join(c.DataDir, "replays")
+}
+
+// Upgrader makes the websocket upgrader for the server's handlers. Browsers always say which page opened a websocket, and only pages
+// from the server itself or one of the allowed origins are accepted, so other sites can't use a player's login cookie.
+func (c *Config) Upgrader() *websocket.Upgrader {
+	allowed := make(map[string]bool)
+	for _, origin := range c.AllowedOrigins {
+		allowed[strings.ToLower(origin)] = true
+	}
+	return &websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || allowed["*"] || allowed[strings.ToLower(origin)] {
+			return true
+		}
+		parsed, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(parsed.Host, r.Host)
+	}}
+}
+
+// Server makes the HTTP server for the handler.
+func (c *Config) Server(handler http.Handler) *http.Server {
+	return &http.Server{Addr: c.Listen, Handler: handler}
+}
+
+// ListenAndServe serves HTTP on the server, or HTTPS if a certificate was given. Like http.Server.ListenAndServe, it returns
+// http.ErrServerClosed once the server is shut down.
+func (c *Config) ListenAndServe(server *http.Server) error {
+	if c.TLSCert != "" {
+		return server.ListenAndServeTLS(c.TLSCert, c.TLSKey)
+	}
+	return server.ListenAndServe()
+}
+
+// LogLevel is how important a log message is. Messages less important than LOG_LEVEL aren't logged.
+type LogLevel int
+
+const (
+	LOG_DEBUG LogLevel = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+var LOG_LEVELS = map[string]LogLevel{"debug": LOG_DEBUG, "info": LOG_INFO, "warn": LOG_WARN, "error": LOG_ERROR}
+
+var LOG_LEVEL LogLevel = LOG_INFO
+
+func logAt(level LogLevel, v ...interface{}) {
+	if level >= LOG_LEVEL {
+		log.Println(v...)
+	}
+}
+
+func logDebug(v ...interface{}) { logAt(LOG_DEBUG, v...) }
+func logInfo(v ...interface{})  { logAt(LOG_INFO, v...) }
+func logWarn(v ...interface{})  { logAt(LOG_WARN, v...) }
+func logError(v ...interface{}) { logAt(LOG_ERROR, v...) }
@@ -0,0 +1,337 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// A match in the league is called a draw if it's still going after this many cycles, since rules without a time limit can let two
+// careful bots block forever.
+const DEFAULT_LEAGUE_MAX_TICKS int = 100000
+
+// The z-score for the 95% confidence intervals in the standings.
+const LEAGUE_CONFIDENCE_Z float64 = 1.96
+
+// A LeagueEntrant is a bot that can play in the league. New makes a fresh one for every match, so nothing carries over between them.
+type LeagueEntrant struct {
+	Name string
+	New  func(rules *Rules, seed int64) Bot
+}
+
+// leagueEntrants returns every bot the league knows about: the computer at each difficulty, and a dummy for each training behavior.
+func leagueEntrants() []LeagueEntrant {
+	entrants := make([]LeagueEntrant, 0, len(DIFFICULTIES)+len(DUMMY_BEHAVIORS))
+	difficulties := make([]string, 0, len(DIFFICULTIES))
+	for name := range DIFFICULTIES {
+		difficulties = append(difficulties, name)
+	}
+	sort.Strings(difficulties)
+	for _, name := range difficulties {
+		difficulty := DIFFICULTIES[name]
+		entrants = append(entrants, LeagueEntrant{Name: name, New: func(rules *Rules, seed int64) Bot { return NewAIPlayer(difficulty, rules, seed) }})
+	}
+	for _, name := range dummyNames() {
+		behavior := DUMMY_BEHAVIORS[name]
+		entrants = append(entrants, LeagueEntrant{Name: "dummy-" + name, New: func(rules *Rules, seed int64) Bot { return NewDummy(behavior, rules, seed) }})
+	}
+	return entrants
+}
+
+// LeagueGame is one match for the league to play: which entrants are player 1 and player 2, and the seed for the match.
+type LeagueGame struct {
+	Players [2]int
+	Seed    int64
+}
+
+// LeagueResult is how a LeagueGame went. Winner is 0 or 1 for player 1 or 2, or -1 for a draw. Unfinished is set if the match hit the
+// cycle limit. Errors counts the cycles where the rules tried to make an illegal state transition.
+type LeagueResult struct {
+	Game       LeagueGame
+	Winner     int
+	Ticks      int
+	Unfinished bool
+	Errors     int
+}
+
+// playLeagueGame plays a match between two bots as fast as it can. There's no clock: every cycle the bots get the Updates from the last
+// one and their commands go into the next, which is how they'd arrive in a real battle with a perfect connection.
+func playLeagueGame(game LeagueGame, bots [2]Bot, rules *Rules, maxTicks int) LeagueResult {
+	result := LeagueResult{Game: game, Winner: -1}
+	sim := NewSimulation(game.Seed, rules)
+	updates := sim.Updates()
+	for !sim.Over() {
+		if sim.Tick >= maxTicks {
+			result.Unfinished = true
+			break
+		}
+		var inputs [2]string
+		for p, bot := range bots {
+			inputs[p] = bot.Act(updates[p])
+		}
+		var err error
+		updates, err = sim.Step(inputs)
+		if err != nil {
+			result.Errors++
+		}
+	}
+	result.Ticks = sim.Tick
+	if !result.Unfinished {
+		if sim.Wins[0] > sim.Wins[1] {
+			result.Winner = 0
+		} else if sim.Wins[1] > sim.Wins[0] {
+			result.Winner = 1
+		}
+	}
+	return result
+}
+
+// LeagueRecord is how one entrant did, either overall or against one opponent.
+type LeagueRecord struct {
+	Won   int
+	Drawn int
+	Lost  int
+}
+
+func (r LeagueRecord) Played() int {
+	return r.Won + r.Drawn + r.Lost
+}
+
+// Score is the fraction of the points the entrant got, where a win is worth a point and a draw half a point.
+func (r LeagueRecord) Score() float64 {
+	if r.Played() == 0 {
+		return 0
+	}
+	return (float64(r.Won) + float64(r.Drawn)/2) / float64(r.Played())
+}
+
+// Interval returns the 95% Wilson score interval for the entrant's score. A draw counts as half a win, which makes the interval a
+// little wider than it needs to be when there are lots of draws, never narrower.
+func (r LeagueRecord) Interval() (float64, float64) {
+	n := float64(r.Played())
+	if n == 0 {
+		return 0, 1
+	}
+	p, z := r.Score(), LEAGUE_CONFIDENCE_Z
+	center := (p + z*z/(2*n)) / (1 + z*z/n)
+	spread := z * math.Sqrt(p*(1-p)/n+z*z/(4*n*n)) / (1 + z*z/n)
+	return math.Max(0, center-spread), math.Min(1, center+spread)
+}
+
+func (r *LeagueRecord) add(winner, side int) {
+	switch winner {
+	case -1:
+		r.Drawn++
+	case side:
+		r.Won++
+	default:
+		r.Lost++
+	}
+}
+
+// League is a round robin between some entrants. Every pair plays a match for each seed from each side, so that neither gets the
+// better side of a seed.
+type League struct {
+	Entrants  []LeagueEntrant
+	Rules     *Rules
+	Seeds     int
+	FirstSeed int64
+	MaxTicks  int
+	Workers   int
+	// How each entrant did overall, and against each other entrant.
+	Records    []LeagueRecord
+	HeadToHead [][]LeagueRecord
+	Games      int
+	Ticks      int
+	Unfinished int
+	Errors     int
+}
+
+func (l *League) games() []LeagueGame {
+	games := make([]LeagueGame, 0)
+	for i := range l.Entrants {
+		for j := i + 1; j < len(l.Entrants); j++ {
+			for s := 0; s < l.Seeds; s++ {
+				seed := l.FirstSeed + int64(s)
+				games = append(games, LeagueGame{Players: [2]int{i, j}, Seed: seed}, LeagueGame{Players: [2]int{j, i}, Seed: seed})
+			}
+		}
+	}
+	return games
+}
+
+// Play plays every match, spread over the workers, and adds up the results. The results only depend on the seeds, not on how many
+// workers there are or what order the matches finish in.
+func (l *League) Play() {
+	games := l.games()
+	results := make([]LeagueResult, len(games))
+	next := make(chan int)
+	var running sync.WaitGroup
+	for w := 0; w < l.Workers; w++ {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			for i := range next {
+				game := games[i]
+				// Each bot gets its own seed, different from the match's, so that the two of them don't make the same random choices.
+				var bots [2]Bot
+				for p, entrant := range game.Players {
+					bots[p] = l.Entrants[entrant].New(l.Rules, game.Seed*2+int64(p)+1)
+				}
+				results[i] = playLeagueGame(game, bots, l.Rules, l.MaxTicks)
+			}
+		}()
+	}
+	for i := range games {
+		next <- i
+	}
+	close(next)
+	running.Wait()
+
+	l.Records = make([]LeagueRecord, len(l.Entrants))
+	l.HeadToHead = make([][]LeagueRecord, len(l.Entrants))
+	for i := range l.HeadToHead {
+		l.HeadToHead[i] = make([]LeagueRecord, len(l.Entrants))
+	}
+	for _, result := range results {
+		for side, entrant := range result.Game.Players {
+			l.Records[entrant].add(result.Winner, side)
+			l.HeadToHead[entrant][result.Game.Players[1-side]].add(result.Winner, side)
+		}
+		l.Games++
+		l.Ticks += result.Ticks
+		if result.Unfinished {
+			l.Unfinished++
+		}
+		l.Errors += result.Errors
+	}
+}
+
+// Print writes the standings, best score first, and then every entrant's score against every other.
+func (l *League) Print() {
+	order := make([]int, len(l.Entrants))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return l.Records[order[a]].Score() > l.Records[order[b]].Score() })
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "rank\tbot\tplayed\twon\tdrawn\tlost\tscore\t95% interval\t")
+	for rank, i := range order {
+		record := l.Records[i]
+		low, high := record.Interval()
+		fmt.Fprintf(table, "%d\t%s\t%d\t%d\t%d\t%d\t%.1f%%\t%.1f%% - %.1f%%\t\n", rank+1, l.Entrants[i].Name, record.Played(), record.Won,
+			record.Drawn, record.Lost, 100*record.Score(), 100*low, 100*high)
+	}
+	table.Flush()
+
+	fmt.Println("\nScore of each bot (down the side) against each other bot (across the top):")
+	table = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	header := "\t"
+	for _, j := range order {
+		header += l.Entrants[j].Name + "\t"
+	}
+	fmt.Fprintln(table, header)
+	for _, i := range order {
+		line := l.Entrants[i].Name + "\t"
+		for _, j := range order {
+			if i == j {
+				line += "-\t"
+			} else {
+				line += fmt.Sprintf("%.0f%%\t", 100*l.HeadToHead[i][j].Score())
+			}
+		}
+		fmt.Fprintln(table, line)
+	}
+	table.Flush()
+}
+
+// runLeague is the league subcommand: `fighting-game league [flags]`. It plays the chosen bots against each other under some rules and
+// prints the standings, without starting the server.
+func runLeague(args []string) error {
+	entrants := leagueEntrants()
+	names := make([]string, len(entrants))
+	for i, entrant := range entrants {
+		names[i] = entrant.Name
+	}
+	flags := flag.NewFlagSet("fighting-game league", flag.ContinueOnError)
+	botList := flags.String("bots", strings.Join(names, ","), "which bots to play against each other, from "+strings.Join(names, ", "))
+	seeds := flags.Int("seeds", 100, "how many seeds each pair of bots plays, from each side")
+	firstSeed := flags.Int64("seed", 1, "the first seed; the rest follow it")
+	rulesName := flags.String("rules", DEFAULT_RULES, "the ruleset to play under, by name from the rules directory or as the path of a JSON file")
+	maxTicks := flags.Int("max-ticks", DEFAULT_LEAGUE_MAX_TICKS, "call a match a draw if it lasts this many cycles")
+	workers := flags.Int("workers", runtime.NumCPU(), "how many matches to play at once")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	if *seeds < 1 || *maxTicks < 1 || *workers < 1 {
+		return fmt.Errorf("seeds, max-ticks and workers have to be at least 1")
+	}
+
+	var rules *Rules
+	if strings.HasSuffix(*rulesName, ".json") {
+		loaded, err := LoadRules(*rulesName)
+		if err != nil {
+			return err
+		}
+		rules = loaded
+	} else {
+		rulesets, err := LoadRulesets(RULES_DIR)
+		if err != nil {
+			return fmt.Errorf("failed to load rules: %v", err)
+		}
+		var ok bool
+		if rules, ok = rulesets[*rulesName]; !ok {
+			return fmt.Errorf("there are no rules called %s. %s", *rulesName, listRulesets(rulesets))
+		}
+	}
+
+	league := &League{Rules: rules, Seeds: *seeds, FirstSeed: *firstSeed, MaxTicks: *maxTicks, Workers: *workers}
+	byName := make(map[string]LeagueEntrant)
+	for _, entrant := range entrants {
+		byName[entrant.Name] = entrant
+	}
+	picked := make(map[string]bool)
+	for _, name := range strings.Split(*botList, ",") {
+		name = strings.TrimSpace(name)
+		entrant, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("there is no bot called %q. Pick from %s", name, strings.Join(names, ", "))
+		} else if picked[name] {
+			return fmt.Errorf("%s can only be in the league once", name)
+		}
+		picked[name] = true
+		league.Entrants = append(league.Entrants, entrant)
+	}
+	if len(league.Entrants) < 2 {
+		return fmt.Errorf("the league needs at least two bots")
+	}
+
+	fmt.Printf("Playing %d bots under the %s rules, %d matches for each pair.\n\n", len(league.Entrants), rules.Name, 2*league.Seeds)
+	start := time.Now()
+	league.Play()
+	league.Print()
+	fmt.Printf("\nPlayed %d matches, %d cycles in all, in %s.\n", league.Games, league.Ticks, time.Since(start).Round(time.Millisecond))
+	if league.Unfinished > 0 {
+		fmt.Printf("%d matches were called a draw after %d cycles.\n", league.Unfinished, league.MaxTicks)
+	}
+	if league.Errors > 0 {
+		fmt.Printf("The rules tried to make an illegal state transition on %d cycles.\n", league.Errors)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long the health check and /metrics wait for the dispatcher to say how the lobby is doing. A dispatcher that takes longer than
+// this is stuck, and the server is unhealthy.
+const HEALTH_TIMEOUT time.Duration = time.Second
+
+// The metrics the server keeps, which /metrics serves in the Prometheus text format. The lobby's gauges aren't here, since only the
+// dispatcher can look at the lobby; /metrics asks it for a LobbyStats instead.
+var (
+	MESSAGES = newCounter("fighting_game_messages_total",
+		"Messages received from clients, by type, and by command for commands.", "type", "command")
+	REJECTED_MESSAGES = newCounter("fighting_game_rejected_messages_total",
+		"Messages from clients that were rejected, by the code of the error they got back.", "code")
+	OUTBOUND_DROPPED = newCounter("fighting_game_outbound_dropped_total",
+		"Messages to clients that were thrown away because the client was behind, by type. Updates are replaced by newer ones.", "type")
+	SLOW_CLIENTS = newCounter("fighting_game_slow_clients_total",
+		"Websockets that were hung up on because the client couldn't keep up.")
+	WRITE_ERRORS = newCounter("fighting_game_websocket_write_errors_total",
+		"Messages that couldn't be written to a websocket.")
+	TICK_OVERRUNS = newCounter("fighting_game_tick_overruns_total",
+		"Times a battle's work for one wakeup took longer than the tick interval.")
+	TICKS_LATE = newCounter("fighting_game_ticks_late_total",
+		"Battle mainloop cycles that started more than a tick interval after they were due, because the battle was catching up.")
+	TICKS_SKIPPED = newCounter("fighting_game_ticks_skipped_total",
+		"Battle mainloop cycles that were never run because the battle fell too far behind.")
+	TICK_LAG = newHistogram("fighting_game_tick_lag_seconds",
+		"How long after they were due battle mainloop cycles started.",
+		[]float64{.0005, .001, .002, .005, .01, .02, .05, .1})
+	// The tick metrics above add up every battle, so these say which battles are the ones falling behind. Each battle's series go
+	// away when it ends.
+	BATTLE_TICK_LAG = newBattleGauge("fighting_game_battle_tick_lag_seconds",
+		"How long after it was due the latest mainloop cycle of each battle in progress started, by match ID.")
+	BATTLE_TICKS_LATE = newBattleGauge("fighting_game_battle_ticks_late",
+		"Mainloop cycles of each battle in progress that started more than a tick interval after they were due so far, by match ID.")
+	BATTLE_TICKS_SKIPPED = newBattleGauge("fighting_game_battle_ticks_skipped",
+		"Mainloop cycles of each battle in progress that were never run so far, by match ID.")
+	BATTLE_TICK_OVERRUNS = newBattleGauge("fighting_game_battle_tick_overruns",
+		"Times so far that a battle in progress took longer than the tick interval for one wakeup, by match ID.")
+	MATCH_DURATION = newHistogram("fighting_game_match_duration_seconds",
+		"How long finished matches took, including pauses for disconnected players.",
+		[]float64{15, 30, 60, 90, 120, 180, 300, 600})
+)
+
+// LobbyStats is how the lobby is doing at one moment. Clients counts every session, including those whose connection dropped and
+// might come back.
+type LobbyStats struct {
+	Clients  int
+	Ready    int
+	Battles  int
+	Draining bool
+}
+
+// stats is called by the dispatcher to answer a request for LobbyStats.
+func (l *lobby) stats() LobbyStats {
+	stats := LobbyStats{Clients: len(l.clients), Battles: len(l.running), Draining: l.draining}
+	for _, user := range l.clients {
+		if user.Ready {
+			stats.Ready++
+		}
+	}
+	return stats
+}
+
+// askLobby gets the LobbyStats from the dispatcher, giving up after HEALTH_TIMEOUT.
+func askLobby(requests chan<- chan LobbyStats) (LobbyStats, bool) {
+	reply := make(chan LobbyStats, 1)
+	timeout := time.After(HEALTH_TIMEOUT)
+	select {
+	case requests <- reply:
+	case <-timeout:
+		return LobbyStats{}, false
+	}
+	select {
+	case stats := <-reply:
+		return stats, true
+	case <-timeout:
+		return LobbyStats{}, false
+	}
+}
+
+// serveHealth answers 200 if the dispatcher is responding, and 503 if it's stuck or the server is shutting down, so that load
+// balancers stop sending players here.
+func serveHealth(requests chan<- chan LobbyStats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats, ok := askLobby(requests)
+		switch {
+		case !ok:
+			http.Error(w, "the dispatcher isn't responding", http.StatusServiceUnavailable)
+		case stats.Draining:
+			http.Error(w, "the server is shutting down", http.StatusServiceUnavailable)
+		default:
+			fmt.Fprintln(w, "ok")
+		}
+	})
+}
+
+// serveMetrics serves every metric in the Prometheus text format.
+func serveMetrics(requests chan<- chan LobbyStats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		stats, ok := askLobby(requests)
+		up := 0
+		if ok {
+			up = 1
+		}
+		writeGauge(w, "fighting_game_dispatcher_up", "Whether the dispatcher answered in time. The lobby gauges are left out if it didn't.", up)
+		if ok {
+			writeGauge(w, "fighting_game_clients", "Sessions in the lobby, including those waiting for their client to reconnect.", stats.Clients)
+			writeGauge(w, "fighting_game_ready_users", "Users waiting to be matched.", stats.Ready)
+			writeGauge(w, "fighting_game_active_battles", "Matches in progress.", stats.Battles)
+		}
+		// Every battle and every websocket has goroutines of its own, so this is the best sign of how much the server is carrying.
+		writeGauge(w, "go_goroutines", "Goroutines that currently exist.", runtime.NumGoroutine())
+		for _, counter := range []*counter{MESSAGES, REJECTED_MESSAGES, OUTBOUND_DROPPED, SLOW_CLIENTS, WRITE_ERRORS, TICK_OVERRUNS, TICKS_LATE, TICKS_SKIPPED} {
+			counter.write(w)
+		}
+		for _, histogram := range []*histogram{TICK_LAG, MATCH_DURATION} {
+			histogram.write(w)
+		}
+		for _, gauge := range []*battleGauge{BATTLE_TICK_LAG, BATTLE_TICKS_LATE, BATTLE_TICKS_SKIPPED, BATTLE_TICK_OVERRUNS} {
+			gauge.write(w)
+		}
+	})
+}
+
+func writeGauge(w io.Writer, name, help string, value int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// A counter only goes up. It has a separate value for each combination of values of its labels.
+type counter struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	// Values by their labels, already formatted for the text format.
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	return &counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// Inc adds one to the counter with these label values, which must be in the same order as the counter's labels.
+func (c *counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counter) Add(value float64, labelValues ...string) {
+	pairs := make([]string, len(c.labels))
+	for i, label := range c.labels {
+		pairs[i] = label + `="` + labelEscaper.Replace(labelValues[i]) + `"`
+	}
+	key := ""
+	if len(pairs) > 0 {
+		key = "{" + strings.Join(pairs, ",") + "}"
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[key] += value
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	// Counters without labels are always there, even before they've counted anything.
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, key, c.values[key])
+	}
+}
+
+// A histogram counts observations in buckets by their upper bounds, which have to be in increasing order.
+type histogram struct {
+	name    string
+	help    string
+	bounds  []float64
+	mutex   sync.Mutex
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(name, help string, bounds []float64) *histogram {
+	return &histogram{name: name, help: help, bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) Observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, bound, h.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", h.name, h.count, h.name, h.sum, h.name, h.count)
+}
+
+// A battleGauge has a value for each battle in progress, labeled with the match ID. A battle's value is removed when it ends, so the
+// gauge doesn't keep growing with every match the server has ever run.
+type battleGauge struct {
+	name   string
+	help   string
+	mutex  sync.Mutex
+	values map[int]float64
+}
+
+func newBattleGauge(name, help string) *battleGauge {
+	return &battleGauge{name: name, help: help, values: make(map[int]float64)}
+}
+
+func (g *battleGauge) Set(match int, value float64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values[match] = value
+}
+
+// Remove forgets a battle that has ended.
+func (g *battleGauge) Remove(match int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	delete(g.values, match)
+}
+
+func (g *battleGauge) write(w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	matches := make([]int, 0, len(g.values))
+	for match := range g.values {
+		matches = append(matches, match)
+	}
+	sort.Ints(matches)
+	for _, match := range matches {
+		fmt.Fprintf(w, "%s{match=\"%d\"} %g\n", g.name, match, g.values[match])
+	}
+}
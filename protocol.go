@@ -0,0 +1,336 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strconv"
+)
+
+// The version of the websocket protocol described in this file. Version 1 was the original format, where every message was a Message
+// with its meaning packed into Command and Content, and updates were sent bare. Clients say which version they speak by connecting
+// with ?version=<n>, and the server answers with a "welcome" envelope holding the version it will use. Clients that don't say, or
+// that only speak older versions, get an "unsupported_version" error and are hung up on.
+const PROTOCOL_VERSION int = 2
+
+// The oldest version the server still speaks.
+const MIN_PROTOCOL_VERSION int = 2
+
+// Chat messages longer than this are rejected.
+const MAX_CHAT_LENGTH int = 500
+
+// Every message in either direction is an Envelope. Type says what kind of message it is, and Data holds the message itself, which is
+// a different struct for each type. Version is the protocol version the message was written for.
+type Envelope struct {
+	Version int         `json:"version"`
+	Type    string      `json:"type"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func NewEnvelope(messageType string, data interface{}) Envelope {
+	return Envelope{Version: PROTOCOL_VERSION, Type: messageType, Data: data}
+}
+
+// These are the types clients can send, and what goes in Data for each of them.
+const (
+	// ChatRequest: a chat message to everyone in the same room.
+	TYPE_CHAT string = "chat"
+	// CommandRequest: a lobby command, like readying up or joining a room.
+	TYPE_COMMAND string = "command"
+	// InputRequest: a battle input.
+	TYPE_INPUT string = "input"
+)
+
+// These are the types the server sends, besides chat messages.
+const (
+	// Welcome: sent first, once the version has been agreed on.
+	TYPE_WELCOME string = "welcome"
+	// Session: the session the client is attached to. See session.go.
+	TYPE_SESSION string = "session"
+	// GameStart: a battle is starting, or resuming after the client reconnected.
+	TYPE_START_GAME  string = "start_game"
+	TYPE_RESUME_GAME string = "resume_game"
+	// SpectatingStart: the client is now watching a match.
+	TYPE_START_SPECTATING string = "start_spectating"
+	// Update and SpectatorUpdate, once every mainloop cycle of the battle.
+	TYPE_UPDATE           string = "update"
+	TYPE_SPECTATOR_UPDATE string = "spectator_update"
+	// TrainingStatus: the dummy and settings of a training match, sent when it starts and whenever they change.
+	TYPE_TRAINING string = "training"
+	// ProtocolError: something the client sent was rejected.
+	TYPE_ERROR string = "error"
+)
+
+// The codes a ProtocolError can have.
+const (
+	ERROR_UNSUPPORTED_VERSION string = "unsupported_version"
+	// The message wasn't a JSON envelope.
+	ERROR_MALFORMED    string = "malformed"
+	ERROR_UNKNOWN_TYPE string = "unknown_type"
+	// The envelope was fine but its data didn't fit its type.
+	ERROR_INVALID string = "invalid"
+	// The message was fine, but it can't be acted on right now, like a battle input from someone who isn't fighting.
+	ERROR_NOT_ALLOWED string = "not_allowed"
+)
+
+type ChatRequest struct {
+	Text string `json:"text"`
+}
+
+type CommandRequest struct {
+	Command  string `json:"command"`
+	Argument string `json:"argument,omitempty"`
+}
+
+// An InputRequest is a battle input. Tick is the tick of the newest Update the client had when the input was pressed.
+type InputRequest struct {
+	Input string `json:"input"`
+	Tick  int    `json:"tick,omitempty"`
+}
+
+// Chat is a chat message. From is "server" for messages from the server itself.
+type Chat struct {
+	From string `json:"from"`
+	Text string `json:"text"`
+}
+
+// Welcome says which protocol version and which encoding for updates the server will use. See binary.go for the encodings, and for
+// what States is.
+type Welcome struct {
+	Version  int      `json:"version"`
+	Encoding string   `json:"encoding"`
+	Username string   `json:"username,omitempty"`
+	States   []string `json:"states,omitempty"`
+}
+
+type Session struct {
+	Token string `json:"token"`
+}
+
+// GameStart carries the rules of the battle so that the client can predict what its own inputs will do.
+type GameStart struct {
+	Rules *Rules `json:"rules"`
+}
+
+type SpectatingStart struct {
+	Match string `json:"match"`
+}
+
+// TrainingStatus has the dummy the player is training against and the ones they can switch to. Dummy is "recording" while it's
+// playing the recording with the given ID, which goes like Sequence.
+type TrainingStatus struct {
+	Dummy     string   `json:"dummy"`
+	Dummies   []string `json:"dummies"`
+	Recording string   `json:"recording,omitempty"`
+	Sequence  string   `json:"sequence,omitempty"`
+	Jitter    int      `json:"jitter"`
+	TrainingSettings
+}
+
+// A ProtocolError tells the client why a message was rejected. Type is the type of the message, if it got far enough to have one.
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Type    string `json:"type,omitempty"`
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func protocolError(code, messageType, format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{Code: code, Message: fmt.Sprintf(format, args...), Type: messageType}
+}
+
+func errorEnvelope(err *ProtocolError) Envelope {
+	return NewEnvelope(TYPE_ERROR, err)
+}
+
+// serverMessage makes a chat message that comes from the server itself rather than another user.
+func serverMessage(content string) Envelope {
+	return NewEnvelope(TYPE_CHAT, Chat{From: "server", Text: content})
+}
+
+// gameMessage tells a client that a battle is starting or resuming.
+func gameMessage(messageType string, rules *Rules) Envelope {
+	return NewEnvelope(messageType, GameStart{Rules: rules})
+}
+
+// Which lobby commands take an argument. Those that take an optional one do something different without it.
+type argument int
+
+const (
+	NO_ARGUMENT argument = iota
+	OPTIONAL_ARGUMENT
+	REQUIRED_ARGUMENT
+)
+
+// Every lobby command a client can send. handleCommand carries them out.
+var LOBBY_COMMANDS = map[string]argument{
+	"READY":           NO_ARGUMENT,
+	"UNREADY":         NO_ARGUMENT,
+	"LIST MATCHES":    NO_ARGUMENT,
+	"SPECTATE":        REQUIRED_ARGUMENT,
+	"STOP SPECTATING": NO_ARGUMENT,
+	"RATINGS":         OPTIONAL_ARGUMENT,
+	"LIST RULES":      NO_ARGUMENT,
+	"SET RULES":       REQUIRED_ARGUMENT,
+	"LIST ROOMS":      NO_ARGUMENT,
+	"CREATE ROOM":     REQUIRED_ARGUMENT,
+	"JOIN ROOM":       REQUIRED_ARGUMENT,
+	"LEAVE ROOM":      NO_ARGUMENT,
+	"INVITE":          REQUIRED_ARGUMENT,
+	"CHALLENGE":       REQUIRED_ARGUMENT,
+	"ACCEPT":          REQUIRED_ARGUMENT,
+	"DECLINE":         REQUIRED_ARGUMENT,
+	"PRACTICE":        OPTIONAL_ARGUMENT,
+	"TRAINING":        OPTIONAL_ARGUMENT,
+	// These can only be used during a training match. See training.go.
+	"DUMMY":            REQUIRED_ARGUMENT,
+	"INFINITE LIFE":    OPTIONAL_ARGUMENT,
+	"INFINITE STAMINA": OPTIONAL_ARGUMENT,
+	"RESET":            NO_ARGUMENT,
+	"END TRAINING":     NO_ARGUMENT,
+	"RECORD":           REQUIRED_ARGUMENT,
+	"PLAYBACK":         REQUIRED_ARGUMENT,
+	"JITTER":           REQUIRED_ARGUMENT,
+	// Lists a player's recordings, or your own without an argument.
+	"RECORDINGS": OPTIONAL_ARGUMENT,
+	// Sent by a player once they've seen the last update of their match.
+	"END MATCH": NO_ARGUMENT,
+}
+
+// Every battle input a client can send.
+var BATTLE_INPUTS = map[string]bool{
+	"NONE":            true,
+	"BLOCK":           true,
+	"LIGHT":           true,
+	"HEAVY":           true,
+	"DODGE":           true,
+	"SAVE":            true,
+	"INTERRUPT_LEFT":  true,
+	"INTERRUPT_UP":    true,
+	"INTERRUPT_RIGHT": true,
+	"INTERRUPT_DOWN":  true,
+}
+
+// A Request is a message from a client that has been decoded and checked. Only the fields for its Type are filled in.
+type Request struct {
+	Type    string
+	Chat    ChatRequest
+	Command CommandRequest
+	Input   InputRequest
+}
+
+// decodeStrict decodes JSON into v, rejecting fields that v doesn't have and anything after the JSON value.
+func decodeStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("unexpected data after the message")
+	}
+	return nil
+}
+
+// ParseRequest decodes a message from a client and checks it against the rules for its type.
+func ParseRequest(message []byte) (Request, *ProtocolError) {
+	var envelope struct {
+		Version int             `json:"version"`
+		Type    string          `json:"type"`
+		Data    json.RawMessage `json:"data"`
+	}
+	var request Request
+	if err := decodeStrict(message, &envelope); err != nil {
+		return request, protocolError(ERROR_MALFORMED, "", "expected a JSON envelope with a version, type and data: %v", err)
+	}
+	request.Type = envelope.Type
+	if envelope.Version != PROTOCOL_VERSION {
+		return request, protocolError(ERROR_UNSUPPORTED_VERSION, envelope.Type, "this connection uses protocol version %d, not %d", PROTOCOL_VERSION, envelope.Version)
+	}
+	if len(envelope.Data) == 0 {
+		return request, protocolError(ERROR_INVALID, envelope.Type, "data is missing")
+	}
+	invalid := func(format string, args ...interface{}) (Request, *ProtocolError) {
+		return request, protocolError(ERROR_INVALID, envelope.Type, format, args...)
+	}
+	switch envelope.Type {
+	case TYPE_CHAT:
+		if err := decodeStrict(envelope.Data, &request.Chat); err != nil {
+			return invalid("%v", err)
+		}
+		if request.Chat.Text == "" {
+			return invalid("text is missing")
+		}
+		if len(request.Chat.Text) > MAX_CHAT_LENGTH {
+			return invalid("chat messages can't be longer than %d characters", MAX_CHAT_LENGTH)
+		}
+	case TYPE_COMMAND:
+		if err := decodeStrict(envelope.Data, &request.Command); err != nil {
+			return invalid("%v", err)
+		}
+		arg, ok := LOBBY_COMMANDS[request.Command.Command]
+		if !ok {
+			return invalid("there is no command %q", request.Command.Command)
+		}
+		if arg == REQUIRED_ARGUMENT && request.Command.Argument == "" {
+			return invalid("%s needs an argument", request.Command.Command)
+		}
+		if arg == NO_ARGUMENT && request.Command.Argument != "" {
+			return invalid("%s doesn't take an argument", request.Command.Command)
+		}
+	case TYPE_INPUT:
+		if err := decodeStrict(envelope.Data, &request.Input); err != nil {
+			return invalid("%v", err)
+		}
+		if !BATTLE_INPUTS[request.Input.Input] {
+			return invalid("there is no input %q", request.Input.Input)
+		}
+		if request.Input.Tick < 0 {
+			return invalid("tick can't be negative")
+		}
+	default:
+		return request, protocolError(ERROR_UNKNOWN_TYPE, envelope.Type, "there is no message type %q", envelope.Type)
+	}
+	return request, nil
+}
+
+// negotiateVersion picks the protocol version to use with a client, going by the newest version it said it speaks.
+func negotiateVersion(r *http.Request) (int, *ProtocolError) {
+	requested := r.URL.Query().Get("version")
+	if requested == "" {
+		return 0, protocolError(ERROR_UNSUPPORTED_VERSION, "", "this client is out of date; the server needs protocol version %d, so reload the page", PROTOCOL_VERSION)
+	}
+	version, err := strconv.Atoi(requested)
+	if err != nil {
+		return 0, protocolError(ERROR_UNSUPPORTED_VERSION, "", "version must be a number, not %q", requested)
+	}
+	if version > PROTOCOL_VERSION {
+		version = PROTOCOL_VERSION
+	}
+	if version < MIN_PROTOCOL_VERSION {
+		return 0, protocolError(ERROR_UNSUPPORTED_VERSION, "", "protocol version %d is too old; the server needs at least version %d, so reload the page", version, MIN_PROTOCOL_VERSION)
+	}
+	return version, nil
+}
+
+// rejectVersion tells a client that connected with a version the server doesn't speak why it's being hung up on. Clients that didn't
+// ask for a version at all are probably from before versions existed, so they're told in the old format too, which shows up in their
+// chat box.
+func rejectVersion(socket *websocket.Conn, r *http.Request, err *ProtocolError) {
+	if r.URL.Query().Get("version") == "" {
+		socket.WriteJSON(map[string]string{"username": "server", "message": err.Message, "command": ""})
+	} else {
+		socket.WriteJSON(errorEnvelope(err))
+	}
+	socket.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseProtocolError, err.Code))
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// A client that has this many messages waiting for it is hung up on right away, however long it's been behind.
+const MAX_OUTBOUND_QUEUE int = 1000
+
+// OutboundPolicy decides what happens when a client can't keep up with what's being sent to it. Everything sent to a session waits in
+// its OutboundQueue until the websocket is ready for it, so the dispatcher and battles never wait on a slow client. Only the latest
+// update of each kind is kept, since older ones are out of date anyway. At most MaxChat chat messages from other users are kept, and
+// the oldest are dropped to make room. A client that doesn't take a single message for SlowClientTimeout while some are waiting, or
+// that takes longer than that to write one, is hung up on. Its session is kept, so it can reconnect and catch up.
+type OutboundPolicy struct {
+	MaxChat           int
+	SlowClientTimeout time.Duration
+}
+
+// The policy new sessions use. It's set from the config.
+var OUTBOUND_POLICY OutboundPolicy = DefaultConfig().Outbound
+
+// An OutboundQueue holds the messages waiting to be sent to a client, in the order they were sent, except that a newer update replaces
+// an older one still waiting. See Push.
+type OutboundQueue struct {
+	policy   OutboundPolicy
+	messages []Envelope
+	// How many of the messages are chat from other users.
+	chats int
+}
+
+func NewOutboundQueue(policy OutboundPolicy) *OutboundQueue {
+	return &OutboundQueue{policy: policy, messages: make([]Envelope, 0)}
+}
+
+// droppable reports whether a message is chat from another user, which is the only kind that can be thrown away.
+func droppable(msg Envelope) bool {
+	chat, ok := msg.Data.(Chat)
+	return msg.Type == TYPE_CHAT && ok && chat.From != "server"
+}
+
+// isUpdate reports whether a message is a battle update, which only matters until a newer one comes.
+func isUpdate(msg Envelope) bool {
+	return msg.Type == TYPE_UPDATE || msg.Type == TYPE_SPECTATOR_UPDATE
+}
+
+// finalUpdate reports whether a message is the last update of a match, which tells the client how it ended.
+func finalUpdate(msg Envelope) bool {
+	switch data := msg.Data.(type) {
+	case Update:
+		return data.Over
+	case SpectatorUpdate:
+		return data.Over
+	}
+	return false
+}
+
+// Push adds a message to the queue. It returns false if the queue is full, which means the client has fallen hopelessly behind.
+// An update replaces the newest waiting update of the same kind, unless that one is the last update of a match, which is always
+// delivered. If only other updates were queued after the old one, the new one takes its place; otherwise the old one is dropped and
+// the new one goes at the end, so that it doesn't arrive before messages that were sent ahead of it, like the start of the next match.
+func (q *OutboundQueue) Push(msg Envelope) bool {
+	switch {
+	case isUpdate(msg):
+		old := -1
+		for i := len(q.messages) - 1; i >= 0; i-- {
+			if q.messages[i].Type == msg.Type {
+				old = i
+				break
+			}
+		}
+		if old < 0 || finalUpdate(q.messages[old]) {
+			break
+		}
+		OUTBOUND_DROPPED.Inc(msg.Type)
+		inPlace := true
+		for _, later := range q.messages[old+1:] {
+			inPlace = inPlace && isUpdate(later)
+		}
+		if inPlace {
+			q.messages[old] = msg
+			return true
+		}
+		q.messages = append(q.messages[:old], q.messages[old+1:]...)
+	case droppable(msg) && q.chats >= q.policy.MaxChat:
+		for i := range q.messages {
+			if droppable(q.messages[i]) {
+				q.messages = append(q.messages[:i], q.messages[i+1:]...)
+				q.chats--
+				OUTBOUND_DROPPED.Inc(TYPE_CHAT)
+				break
+			}
+		}
+	}
+	if len(q.messages) >= MAX_OUTBOUND_QUEUE {
+		return false
+	}
+	if droppable(msg) {
+		q.chats++
+	}
+	q.messages = append(q.messages, msg)
+	return true
+}
+
+func (q *OutboundQueue) Len() int {
+	return len(q.messages)
+}
+
+// Peek returns the next message to send. The queue must not be empty.
+func (q *OutboundQueue) Peek() Envelope {
+	return q.messages[0]
+}
+
+// Pop removes the next message, once it's been sent.
+func (q *OutboundQueue) Pop() {
+	if droppable(q.messages[0]) {
+		q.chats--
+	}
+	q.messages = q.messages[1:]
+}
+
+func (q *OutboundQueue) Clear() {
+	q.messages = q.messages[:0]
+	q.chats = 0
+}
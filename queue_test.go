@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testQueue() *OutboundQueue {
+	return NewOutboundQueue(OutboundPolicy{MaxChat: 3, SlowClientTimeout: time.Second})
+}
+
+func testUpdate(tick int, over bool) Envelope {
+	return NewEnvelope(TYPE_UPDATE, Update{Tick: tick, Over: over})
+}
+
+// drain pops everything in a queue and returns it in the order it would have been sent.
+func drain(q *OutboundQueue) []Envelope {
+	var messages []Envelope
+	for q.Len() > 0 {
+		messages = append(messages, q.Peek())
+		q.Pop()
+	}
+	return messages
+}
+
+// ticks describes a list of messages, with updates by their tick, so they're easy to compare.
+func ticks(messages []Envelope) []interface{} {
+	described := make([]interface{}, len(messages))
+	for i, msg := range messages {
+		if update, ok := msg.Data.(Update); ok {
+			described[i] = update.Tick
+		} else {
+			described[i] = msg.Type
+		}
+	}
+	return described
+}
+
+func checkOrder(t *testing.T, messages []Envelope, want ...interface{}) {
+	t.Helper()
+	got := ticks(messages)
+	if len(got) != len(want) {
+		t.Fatalf("sent %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("sent %v, want %v", got, want)
+		}
+	}
+}
+
+func TestNewerUpdatesReplaceOlderOnes(t *testing.T) {
+	q := testQueue()
+	q.Push(testUpdate(1, false))
+	q.Push(NewEnvelope(TYPE_SPECTATOR_UPDATE, SpectatorUpdate{Round: 1}))
+	q.Push(testUpdate(2, false))
+	q.Push(testUpdate(3, false))
+	// The spectator update is a different kind, so it stays, and the player's update keeps its place in front of it.
+	checkOrder(t, drain(q), 3, TYPE_SPECTATOR_UPDATE)
+}
+
+func TestUpdatesDontJumpAheadOfOtherMessages(t *testing.T) {
+	q := testQueue()
+	q.Push(testUpdate(1, false))
+	q.Push(NewEnvelope(TYPE_START_GAME, nil))
+	q.Push(testUpdate(2, false))
+	checkOrder(t, drain(q), TYPE_START_GAME, 2)
+}
+
+func TestTheLastUpdateOfAMatchIsNeverReplaced(t *testing.T) {
+	q := testQueue()
+	q.Push(testUpdate(1, false))
+	q.Push(testUpdate(2, true))
+	q.Push(testUpdate(3, false))
+	q.Push(testUpdate(4, false))
+	checkOrder(t, drain(q), 2, 4)
+
+	q.Push(NewEnvelope(TYPE_SPECTATOR_UPDATE, SpectatorUpdate{Over: true}))
+	q.Push(NewEnvelope(TYPE_SPECTATOR_UPDATE, SpectatorUpdate{Round: 1}))
+	if messages := drain(q); len(messages) != 2 || !messages[0].Data.(SpectatorUpdate).Over {
+		t.Fatalf("the spectator's last update was replaced: %+v", messages)
+	}
+}
+
+func TestOnlySomeChatIsKept(t *testing.T) {
+	q := testQueue()
+	for i := 0; i < 5; i++ {
+		q.Push(NewEnvelope(TYPE_CHAT, Chat{From: "alice", Text: string(rune('a' + i))}))
+		q.Push(serverMessage("announcement"))
+	}
+	messages := drain(q)
+	var texts string
+	for _, msg := range messages {
+		if chat := msg.Data.(Chat); chat.From == "alice" {
+			texts += chat.Text
+		}
+	}
+	// The oldest chat from other users is dropped, but messages from the server always get through.
+	if texts != "cde" || len(messages) != 8 {
+		t.Fatalf("kept chat %q out of %d messages", texts, len(messages))
+	}
+	if q.chats != 0 {
+		t.Fatalf("an empty queue counts %d chat messages", q.chats)
+	}
+}
+
+func TestAFullQueueRefusesMoreMessages(t *testing.T) {
+	q := testQueue()
+	for i := 0; i < MAX_OUTBOUND_QUEUE; i++ {
+		if !q.Push(serverMessage("announcement")) {
+			t.Fatalf("the queue was full after %d messages", i)
+		}
+	}
+	if q.Push(serverMessage("announcement")) || q.Len() != MAX_OUTBOUND_QUEUE {
+		t.Fatalf("a full queue took another message, it has %d", q.Len())
+	}
+	// An update still can't be added when there's nothing to replace.
+	if q.Push(testUpdate(1, false)) {
+		t.Fatal("a full queue took an update")
+	}
+}
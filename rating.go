@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Elo rating parameters. New players start at STARTING_RATING, and RATING_K is the most a rating can change after a single match.
+const STARTING_RATING float64 = 1500
+const RATING_K float64 = 32
+
+// The matchmaker pairs players whose ratings are within RATING_GAP of each other. The acceptable gap widens by RATING_GAP_GROWTH for
+// every second the longer-waiting player has been ready, so nobody waits forever just because nobody of their level is around.
+const RATING_GAP float64 = 100
+const RATING_GAP_GROWTH float64 = 10
+
+// How often the matchmaker looks at the ready queues again, so that widened gaps can produce matches without anyone readying.
+const MATCHMAKER_INTERVAL time.Duration = time.Second
+
+// Rating is a player's Elo rating along with their record.
+type Rating struct {
+	Rating float64
+	Wins   int
+	Losses int
+	Draws  int
+}
+
+func (r *Rating) String() string {
+	return fmt.Sprintf("%.0f (%d-%d-%d)", r.Rating, r.Wins, r.Losses, r.Draws)
+}
+
+// A MatchResult is sent by battle() to the dispatcher when a match ends. Ticks is how many mainloop cycles the match lasted.
+// Forfeited tells which players lost by staying disconnected for too long.
+type MatchResult struct {
+	Match     *Match
+	Final     [2]Update
+	Ticks     int
+	Stats     [2]BattleStats
+	ReplayID  string
+	Forfeited [2]bool
+	Stopped   bool
+	Timing    TickStats
+}
+
+// Forfeit reports whether the match was decided by someone forfeiting.
+func (r MatchResult) Forfeit() bool {
+	return r.Forfeited[0] || r.Forfeited[1]
+}
+
+// Winner returns the index of the player who won the most rounds, or -1 if they won as many as each other. A player who forfeits
+// loses no matter how many rounds they had won, and a match the server stopped is a draw.
+func (r MatchResult) Winner() int {
+	switch {
+	case r.Stopped:
+		return -1
+	case r.Forfeited[0] && r.Forfeited[1]:
+		return -1
+	case r.Forfeited[1]:
+		return 0
+	case r.Forfeited[0]:
+		return 1
+	case r.Final[0].Wins > r.Final[0].EnemyWins:
+		return 0
+	case r.Final[0].Wins < r.Final[0].EnemyWins:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// rating returns the rating for a username, creating it if the player hasn't played before.
+func (l *lobby) rating(name string) *Rating {
+	rating, ok := l.ratings[name]
+	if !ok {
+		rating = &Rating{Rating: STARTING_RATING}
+		l.ratings[name] = rating
+	}
+	return rating
+}
+
+// currentRating is like rating, but for players who haven't played before it returns a starting rating without storing it.
+func (l *lobby) currentRating(name string) *Rating {
+	if rating, ok := l.ratings[name]; ok {
+		return rating
+	}
+	return &Rating{Rating: STARTING_RATING}
+}
+
+// recordResult saves a finished match, updates the ratings of both players and tells them how it went. Players without a username
+// aren't rated, since there would be no way to tell them apart, and neither are practice matches against the computer or matches the
+// server stopped.
+func (l *lobby) recordResult(result MatchResult) {
+	MATCH_DURATION.Observe(time.Since(result.Match.Started).Seconds())
+	if result.Match.Training != nil {
+		return
+	}
+	if err := l.store.SaveMatch(NewMatchRecord(result)); err != nil {
+		logError("failed to save match:", err)
+	}
+	names := result.Match.Players
+	if result.Match.Practice || result.Stopped || names[0] == "" || names[1] == "" || names[0] == names[1] {
+		return
+	}
+	ratings := l.rate(names, result.Winner())
+	for i, name := range names {
+		if conn := l.findUser(name); conn != nil {
+			conn.Outbound <- serverMessage("Your rating is now " + ratings[i].String() + ".")
+		}
+	}
+}
+
+// rate updates the ratings and records of two players after a match between them. winner is 0 or 1 for the first or second player,
+// or -1 for a draw.
+func (l *lobby) rate(names [2]string, winner int) [2]*Rating {
+	ratings := [2]*Rating{l.rating(names[0]), l.rating(names[1])}
+	// The score is 1 for a win, 0.5 for a draw and 0 for a loss, from player 1's point of view.
+	score := 0.5
+	switch winner {
+	case 0:
+		score = 1
+		ratings[0].Wins++
+		ratings[1].Losses++
+	case 1:
+		score = 0
+		ratings[0].Losses++
+		ratings[1].Wins++
+	default:
+		ratings[0].Draws++
+		ratings[1].Draws++
+	}
+	expected := 1 / (1 + math.Pow(10, (ratings[1].Rating-ratings[0].Rating)/400))
+	change := RATING_K * (score - expected)
+	ratings[0].Rating += change
+	ratings[1].Rating -= change
+	return ratings
+}
+
+// loadRatings works out everyone's rating from the match history when the server starts, by rating every match again in the order
+// they were played. The same matches count as in recordResult. Records from before practice matches were marked can still be told
+// apart, since the computer's name isn't a valid username.
+func (l *lobby) loadRatings() error {
+	records, err := l.store.Matches()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Date.Before(records[j].Date) })
+	rated := 0
+	for _, record := range records {
+		names := record.Players
+		if record.Practice || record.Stopped || names[0] == names[1] || !USERNAME_PATTERN.MatchString(names[0]) || !USERNAME_PATTERN.MatchString(names[1]) {
+			continue
+		}
+		winner := -1
+		for i, name := range names {
+			if record.Winner == name {
+				winner = i
+			}
+		}
+		l.rate(names, winner)
+		rated++
+	}
+	logInfo(fmt.Sprintf("rated %d players from %d matches", len(l.ratings), rated))
+	return nil
+}
+
+// listRatings describes the rating of the named player, or the top ten players if no name is given.
+func (l *lobby) listRatings(name string) string {
+	if name != "" {
+		return name + " is rated " + l.currentRating(name).String() + "."
+	}
+	names := make([]string, 0, len(l.ratings))
+	for name := range l.ratings {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return "Nobody has been rated yet."
+	}
+	sort.Slice(names, func(i, j int) bool { return l.ratings[names[i]].Rating > l.ratings[names[j]].Rating })
+	if len(names) > 10 {
+		names = names[:10]
+	}
+	description := "Top players:"
+	for i, name := range names {
+		description += fmt.Sprintf(" [%d. %s %s]", i+1, name, l.ratings[name])
+	}
+	return description
+}
+
+// pickPair finds the two ready players in a room who are closest in rating, as long as they're close enough given how long they've
+// been waiting. It returns nil if nobody can be matched yet. Ties go to whoever readied first.
+func (l *lobby) pickPair(room *Room, now time.Time) []*ConnInfo {
+	var best []*ConnInfo
+	bestGap := math.Inf(1)
+	for i, a := range room.Queue {
+		for _, b := range room.Queue[i+1:] {
+			gap := math.Abs(l.currentRating(l.clients[a].Name).Rating - l.currentRating(l.clients[b].Name).Rating)
+			// The queue is in the order people readied, so a has been waiting longer than b.
+			allowed := RATING_GAP + RATING_GAP_GROWTH*now.Sub(l.clients[a].ReadySince).Seconds()
+			if gap <= allowed && gap < bestGap {
+				best = []*ConnInfo{a, b}
+				bestGap = gap
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRatingsAreRebuiltFromTheHistory(t *testing.T) {
+	classic := DefaultRules()
+	store := NewMemoryStore()
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := []MatchRecord{
+		// Saved out of order, to show that they're rated in the order they were played.
+		{Date: start.Add(time.Hour), Players: [2]string{"bob", "alice"}, Winner: ""},
+		{Date: start, Players: [2]string{"alice", "bob"}, Winner: "alice"},
+		// None of these are rated.
+		{Date: start.Add(2 * time.Hour), Players: [2]string{"alice", "computer (hard)"}, Winner: "computer (hard)", Practice: true},
+		{Date: start.Add(3 * time.Hour), Players: [2]string{"alice", "computer (hard)"}, Winner: "computer (hard)"},
+		{Date: start.Add(4 * time.Hour), Players: [2]string{"alice", "bob"}, Winner: "", Stopped: true},
+	}
+	for _, record := range records {
+		if err := store.SaveMatch(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := newLobby(store, nil, map[string]*Rules{DEFAULT_RULES: &classic}, nil)
+
+	// Alice's win takes 16 points from Bob, and then the draw gives some back to him.
+	alice := STARTING_RATING + RATING_K/2
+	expected := 1 / (1 + math.Pow(10, ((2*STARTING_RATING-alice)-alice)/400))
+	alice += RATING_K * (0.5 - expected)
+	if len(l.ratings) != 2 {
+		t.Fatalf("only alice and bob should be rated: %v", l.ratings)
+	}
+	got, bob := l.ratings["alice"], l.ratings["bob"]
+	if math.Abs(got.Rating-alice) > 1e-9 || math.Abs(bob.Rating-(2*STARTING_RATING-alice)) > 1e-9 {
+		t.Fatalf("alice is %v and bob is %v, want %.2f and %.2f", got, bob, alice, 2*STARTING_RATING-alice)
+	}
+	if got.Wins != 1 || got.Draws != 1 || got.Losses != 0 || bob.Losses != 1 || bob.Draws != 1 {
+		t.Fatalf("alice is %v and bob is %v", got, bob)
+	}
+}
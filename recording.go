@@ -0,0 +1,265 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recordings are appended to this file, one JSON object per line.
+var RECORDING_STORE_PATH string = "recordings.jsonl"
+
+// Recordings are kept short, since they're meant for drilling one situation over and over.
+const MAX_RECORDING_STEPS int = 50
+
+// The longest a single wait in a recording can be, in cycles, which is 10 seconds.
+const MAX_RECORDING_WAIT int = 1000
+
+// The most a player can have the dummy shift each wait by, in cycles, either way.
+const MAX_JITTER int = 100
+
+// A RecordingStep is one thing the dummy does in a recording: press a battle input, or wait a number of cycles before the next step.
+type RecordingStep struct {
+	Command string `json:"command,omitempty"`
+	Wait    int    `json:"wait,omitempty"`
+}
+
+// A Recording is a sequence of inputs a player wrote for the training dummy, which loops it. Anyone who knows the ID can play it.
+type Recording struct {
+	ID      string          `json:"id"`
+	Owner   string          `json:"owner"`
+	Steps   []RecordingStep `json:"steps"`
+	Created time.Time       `json:"created"`
+}
+
+// parseRecording reads a sequence like "HEAVY, wait 40 ticks, LIGHT". The steps are separated by commas, and each one is either a
+// battle input or "wait" followed by a number of cycles. It returns an error meant for the player if the sequence doesn't make sense.
+func parseRecording(text string) ([]RecordingStep, error) {
+	steps := make([]RecordingStep, 0)
+	for _, part := range strings.Split(text, ",") {
+		words := strings.Fields(strings.ToUpper(part))
+		if len(words) == 0 {
+			continue
+		}
+		if words[0] != "WAIT" {
+			command := strings.Join(words, "_")
+			if !BATTLE_INPUTS[command] {
+				return nil, fmt.Errorf("%q isn't a battle input or a wait", strings.TrimSpace(part))
+			}
+			steps = append(steps, RecordingStep{Command: command})
+			continue
+		}
+		if len(words) < 2 || len(words) > 3 || (len(words) == 3 && words[2] != "TICKS" && words[2] != "TICK") {
+			return nil, fmt.Errorf("%q should look like \"wait 40 ticks\"", strings.TrimSpace(part))
+		}
+		wait, err := strconv.Atoi(words[1])
+		if err != nil || wait < 1 || wait > MAX_RECORDING_WAIT {
+			return nil, fmt.Errorf("waits have to be from 1 to %d ticks, not %s", MAX_RECORDING_WAIT, words[1])
+		}
+		steps = append(steps, RecordingStep{Wait: wait})
+	}
+	if len(steps) == 0 {
+		return nil, errors.New("a recording needs at least one input")
+	}
+	if len(steps) > MAX_RECORDING_STEPS {
+		return nil, fmt.Errorf("recordings can't have more than %d steps", MAX_RECORDING_STEPS)
+	}
+	return steps, nil
+}
+
+// String writes the recording back the way players type it.
+func (r *Recording) String() string {
+	parts := make([]string, len(r.Steps))
+	for i, step := range r.Steps {
+		if step.Command != "" {
+			parts[i] = step.Command
+		} else {
+			parts[i] = fmt.Sprintf("wait %d ticks", step.Wait)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// playback is how far the dummy has got through a recording.
+type playback struct {
+	recording *Recording
+	jitter    int
+	random    *rand.Rand
+	step      int
+	// The tick the next step is due, and the command to hold until then.
+	due     int
+	holding string
+}
+
+// behavior makes a DummyBehavior that loops the recording from the start, shifting each wait by up to jitter cycles either way.
+// Each press only lasts one cycle, like a key press in the browser, except for BLOCK, which is held until the next input.
+func (r *Recording) behavior(jitter int, seed int64) DummyBehavior {
+	p := &playback{recording: r, jitter: jitter, random: rand.New(rand.NewSource(seed)), due: -1, holding: "NONE"}
+	return DummyBehavior{Name: "recording", Description: "plays recording " + r.ID, decide: p.decide}
+}
+
+func (p *playback) decide(d *Dummy, self, enemy PlayerStatus) string {
+	if p.due < 0 {
+		p.due = d.tick
+	}
+	// Waits that are already over are skipped straight through, but a recording of nothing but waits still only goes around once a
+	// cycle.
+	for i := 0; i < len(p.recording.Steps) && d.tick >= p.due; i++ {
+		step := p.recording.Steps[p.step]
+		p.step = (p.step + 1) % len(p.recording.Steps)
+		if step.Command == "" {
+			p.due += max(step.Wait+p.shift(), 0)
+			continue
+		}
+		p.due = d.tick + 1
+		p.holding = "NONE"
+		if step.Command == "BLOCK" {
+			p.holding = "BLOCK"
+		}
+		return step.Command
+	}
+	return p.holding
+}
+
+// shift picks how far to move a wait, from -jitter to jitter.
+func (p *playback) shift() int {
+	if p.jitter == 0 {
+		return 0
+	}
+	return p.random.Intn(2*p.jitter+1) - p.jitter
+}
+
+// Recordings keeps every recording players have saved. It's used from the dispatcher and the HTTP handlers, so like the match stores
+// it has its own mutex. If it was opened from a file, new recordings are appended to it.
+type Recordings struct {
+	mutex      sync.Mutex
+	recordings map[string]*Recording
+	file       *os.File
+}
+
+// NewRecordings makes a Recordings that forgets everything when the server stops.
+func NewRecordings() *Recordings {
+	return &Recordings{recordings: make(map[string]*Recording)}
+}
+
+func OpenRecordings(path string) (*Recordings, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	recordings := NewRecordings()
+	recordings.file = file
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var recording Recording
+		if err := json.Unmarshal(scanner.Bytes(), &recording); err != nil {
+			file.Close()
+			return nil, err
+		}
+		recordings.recordings[recording.ID] = &recording
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return recordings, nil
+}
+
+func (r *Recordings) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// Save gives a new recording an ID and keeps it.
+func (r *Recordings) Save(owner string, steps []RecordingStep) (*Recording, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var id string
+	for id == "" || r.recordings[id] != nil {
+		token, err := newToken()
+		if err != nil {
+			return nil, err
+		}
+		// IDs are typed by hand, so they're kept short.
+		id = token[:8]
+	}
+	recording := &Recording{ID: id, Owner: owner, Steps: steps, Created: time.Now()}
+	if r.file != nil {
+		line, err := json.Marshal(recording)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := r.file.Write(append(line, '\n')); err != nil {
+			return nil, err
+		}
+	}
+	r.recordings[id] = recording
+	return recording, nil
+}
+
+func (r *Recordings) Get(id string) (*Recording, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	recording, ok := r.recordings[id]
+	return recording, ok
+}
+
+// ByOwner returns every recording a player has saved, oldest first.
+func (r *Recordings) ByOwner(owner string) []*Recording {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	owned := make([]*Recording, 0)
+	for _, recording := range r.recordings {
+		if recording.Owner == owner {
+			owned = append(owned, recording)
+		}
+	}
+	sort.Slice(owned, func(i, j int) bool { return owned[i].Created.Before(owned[j].Created) })
+	return owned
+}
+
+// listRecordings describes a player's recordings for the chat.
+func (l *lobby) listRecordings(owner string) string {
+	recordings := l.recordings.ByOwner(owner)
+	if len(recordings) == 0 {
+		return owner + " has no recordings."
+	}
+	descriptions := make([]string, len(recordings))
+	for i, recording := range recordings {
+		descriptions[i] = recording.ID + ": " + recording.String()
+	}
+	return "Recordings by " + owner + ": " + strings.Join(descriptions, "; ")
+}
+
+// serveRecordings serves a recording as JSON if the query string has an ID, or every recording by the player it names.
+func serveRecordings(recordings *Recordings) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if id := r.URL.Query().Get("id"); id != "" {
+			recording, ok := recordings.Get(id)
+			if !ok {
+				http.Error(w, "there is no recording "+id, http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(recording)
+			return
+		}
+		json.NewEncoder(w).Encode(recordings.ByOwner(r.URL.Query().Get("player")))
+	})
+}
@@ -0,0 +1,278 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The version of the replay file format. It must be bumped whenever the format or the battle rules change in a way that would stop
+// old replays from reproducing, so that old files are rejected instead of silently playing back wrong.
+// Version 2 added the ruleset. Version 3 replaced math/rand with a generator whose state can be saved for rollbacks, which changes
+// which interrupt arrows come up. Version 4 split matches into rounds with a time limit.
+const REPLAY_VERSION int = 4
+
+// Replays are stored in this directory as gzipped JSON, one file per match.
+var REPLAY_DIR string = "replays"
+
+// A ReplayFrame is one mainloop cycle of a recorded match. Inputs are exactly what was passed to Simulation.Step, and Status is what
+// player 1 and player 2 looked like afterward.
+type ReplayFrame struct {
+	Inputs [2]string       `json:"inputs"`
+	Status [2]PlayerStatus `json:"status"`
+}
+
+// A Replay is everything needed to reproduce a match: the rules, the seed for the random number generator and the input of every
+// cycle. The rules are copied in full so that the replay still works after the ruleset is changed. The recorded statuses are only
+// used to check that the playback matches what actually happened.
+type Replay struct {
+	Version int           `json:"version"`
+	ID      string        `json:"id"`
+	Date    time.Time     `json:"date"`
+	Seed    int64         `json:"seed"`
+	Rules   Rules         `json:"rules"`
+	Frames  []ReplayFrame `json:"frames"`
+	Final   [2]Update     `json:"final"`
+}
+
+// NewReplay starts an empty recording for a match that uses the given seed and rules.
+func NewReplay(seed int64, rules *Rules) *Replay {
+	date := time.Now()
+	id := fmt.Sprintf("%s-%x", date.Format("20060102-150405"), uint64(seed))
+	return &Replay{Version: REPLAY_VERSION, ID: id, Date: date, Seed: seed, Rules: *rules}
+}
+
+// AddFrame records one call to Simulation.Step along with its result.
+func (r *Replay) AddFrame(inputs [2]string, updates [2]Update) {
+	r.Frames = append(r.Frames, ReplayFrame{Inputs: inputs, Status: [2]PlayerStatus{updates[0].Self, updates[1].Self}})
+	r.Final = updates
+}
+
+// ReplayPlayer feeds a Replay back through a Simulation one cycle at a time, checking each cycle against the recording.
+type ReplayPlayer struct {
+	replay *Replay
+	sim    *Simulation
+	frame  int
+}
+
+func NewReplayPlayer(replay *Replay) (*ReplayPlayer, error) {
+	rules := replay.Rules
+	if replay.Version != REPLAY_VERSION {
+		return nil, fmt.Errorf("replay %s has version %d, but only version %d is supported", replay.ID, replay.Version, REPLAY_VERSION)
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, fmt.Errorf("replay %s: %v", replay.ID, err)
+	}
+	return &ReplayPlayer{replay: replay, sim: NewSimulation(replay.Seed, &rules)}, nil
+}
+
+// Updates returns the current state of the playback, the same way Simulation.Updates does.
+func (rp *ReplayPlayer) Updates() [2]Update {
+	return rp.sim.Updates()
+}
+
+// Next plays the next recorded cycle. It returns false once the recording is exhausted, and an error if the simulation no longer
+// produces the recorded result.
+func (rp *ReplayPlayer) Next() ([2]Update, bool, error) {
+	if rp.frame >= len(rp.replay.Frames) {
+		return rp.sim.Updates(), false, nil
+	}
+	frame := rp.replay.Frames[rp.frame]
+	rp.frame++
+	updates, err := rp.sim.Step(frame.Inputs)
+	if err != nil {
+		return updates, false, fmt.Errorf("replay %s failed at tick %d: %v", rp.replay.ID, rp.frame, err)
+	}
+	if updates[0].Self != frame.Status[0] || updates[1].Self != frame.Status[1] {
+		return updates, false, fmt.Errorf("replay %s diverged at tick %d: recorded %v, got %v", rp.replay.ID, rp.frame, frame.Status, [2]PlayerStatus{updates[0].Self, updates[1].Self})
+	}
+	return updates, true, nil
+}
+
+// Verify plays the whole replay and checks that it reproduces the recorded match, including the final result.
+func (r *Replay) Verify() error {
+	rp, err := NewReplayPlayer(r)
+	if err != nil {
+		return err
+	}
+	for {
+		_, more, err := rp.Next()
+		if err != nil {
+			return err
+		}
+		if !more {
+			break
+		}
+	}
+	if rp.Updates() != r.Final {
+		return fmt.Errorf("replay %s ended with %v, but the recording ended with %v", r.ID, rp.Updates(), r.Final)
+	}
+	return nil
+}
+
+// replayPath returns the file a replay with the given ID is stored in. IDs come from clients, so anything that could escape the
+// replay directory is rejected.
+func replayPath(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return "", errors.New("invalid replay id")
+	}
+	return filepath.Join(REPLAY_DIR, id+".json.gz"), nil
+}
+
+func saveReplay(replay *Replay) error {
+	path, err := replayPath(replay.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(REPLAY_DIR, 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	zipper := gzip.NewWriter(file)
+	if err := json.NewEncoder(zipper).Encode(replay); err != nil {
+		return err
+	}
+	if err := zipper.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func loadReplay(id string) (*Replay, error) {
+	path, err := replayPath(id)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	unzipper, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	var replay Replay
+	if err := json.NewDecoder(unzipper).Decode(&replay); err != nil {
+		return nil, err
+	}
+	return &replay, nil
+}
+
+// listReplays serves a JSON array of the IDs of all stored replays, oldest first.
+func listReplays() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids := make([]string, 0)
+		files, err := ioutil.ReadDir(REPLAY_DIR)
+		if err != nil && !os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), ".json.gz") {
+				ids = append(ids, strings.TrimSuffix(file.Name(), ".json.gz"))
+			}
+		}
+		sort.Strings(ids)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ids)
+	})
+}
+
+// streamReplay returns a handler that plays a stored replay over a websocket. The client sees exactly what player 1 saw during the
+// match, at the same speed, so the normal battle HUD can be used to watch it.
+func streamReplay(upgrader *websocket.Upgrader, shutdown *Shutdown) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if shutdown.refuse(w) {
+			return
+		}
+		replay, err := loadReplay(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "replay not found", http.StatusNotFound)
+			return
+		}
+		rp, err := NewReplayPlayer(replay)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		socket, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logWarn("websocket upgrade failed:", err)
+			return
+		}
+		defer socket.Close()
+		shutdown.sockets.Add(1)
+		defer shutdown.sockets.Done()
+		version, versionErr := negotiateVersion(r)
+		if versionErr != nil {
+			rejectVersion(socket, r, versionErr)
+			return
+		}
+		encoding := negotiateEncoding(r)
+		writer := newSocketWriter(socket, encoding)
+		if err := writer.Write(welcome(version, encoding, "")); err != nil {
+			return
+		}
+		// Throw away anything the client sends, like its END MATCH message, but notice when it leaves.
+		gone := make(chan bool)
+		go func() {
+			for {
+				if _, _, err := socket.NextReader(); err != nil {
+					close(gone)
+					return
+				}
+			}
+		}()
+
+		if err := writer.Write(gameMessage(TYPE_START_GAME, &replay.Rules)); err != nil {
+			return
+		}
+		ticker := time.NewTicker(TICK_INTERVAL)
+		defer ticker.Stop()
+		updates := rp.Updates()
+		for {
+			select {
+			case <-ticker.C:
+			case <-gone:
+				return
+			case <-shutdown.closing:
+				hangUp(socket)
+				return
+			}
+			if err := writer.Write(NewEnvelope(TYPE_UPDATE, updates[0])); err != nil {
+				return
+			}
+			var more bool
+			updates, more, err = rp.Next()
+			if err != nil {
+				logError(err)
+				return
+			}
+			if !more {
+				// Let the client know it's over, the same way a live match ends.
+				updates[0].Over = true
+				writer.Write(NewEnvelope(TYPE_UPDATE, updates[0]))
+				return
+			}
+		}
+	})
+}
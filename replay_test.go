@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// recordTestMatch plays a whole match with random inputs and records it the same way battle() does.
+func recordTestMatch(t *testing.T, seed int64) *Replay {
+	t.Helper()
+	sim := newTestSimulation(seed)
+	replay := NewReplay(seed, sim.Rules)
+	random := rand.New(rand.NewSource(seed))
+	for !sim.Over() {
+		inputs := [2]string{TEST_INPUTS[random.Intn(len(TEST_INPUTS))], TEST_INPUTS[random.Intn(len(TEST_INPUTS))]}
+		updates, _ := sim.Step(inputs)
+		replay.AddFrame(inputs, updates)
+	}
+	return replay
+}
+
+func TestSavedReplayReproducesTheMatch(t *testing.T) {
+	defer func(dir string) { REPLAY_DIR = dir }(REPLAY_DIR)
+	REPLAY_DIR = t.TempDir()
+	replay := recordTestMatch(t, 7)
+	if err := saveReplay(replay); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadReplay(replay.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Frames) != len(replay.Frames) || loaded.Final != replay.Final {
+		t.Fatalf("loaded %d frames ending with %+v, saved %d ending with %+v", len(loaded.Frames), loaded.Final, len(replay.Frames), replay.Final)
+	}
+	if err := loaded.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTamperedReplayFailsToVerify(t *testing.T) {
+	replay := recordTestMatch(t, 7)
+	// Taking away a heavy attack changes everything after it.
+	for i, frame := range replay.Frames {
+		if frame.Inputs[0] == "HEAVY" && frame.Status[0].State == HeavyAttack {
+			replay.Frames[i].Inputs[0] = ""
+			break
+		}
+	}
+	if err := replay.Verify(); err == nil {
+		t.Fatal("a replay with a changed input still verified")
+	}
+
+	// The seed picks the arrow for every interrupt, so with a different one the interrupts go differently.
+	replay = recordTestMatch(t, 7)
+	replay.Seed++
+	if err := replay.Verify(); err == nil {
+		t.Fatal("a replay with the wrong seed still verified")
+	}
+}
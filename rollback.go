@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+// How many cycles back a late input can still change the battle. Inputs from further back are applied on the next cycle instead.
+const ROLLBACK_WINDOW int = 15
+
+// A rollbackFrame is a cycle that can still be redone: the state before it, the inputs it was simulated with, and what came of it.
+type rollbackFrame struct {
+	before  Simulation
+	inputs  [2]string
+	updates [2]Update
+}
+
+// Rollback runs the Simulation for a live match. Clients tag each input with the tick of the newest update they had when it was
+// pressed, so it's meant for the cycle right after that tick, but it usually arrives a few cycles later. The Rollback keeps the last
+// ROLLBACK_WINDOW cycles, and when a late input arrives it goes back to the cycle the input was meant for and simulates forward again
+// from there. Cycles older than that are final, and Step hands them back so that they can be recorded.
+type Rollback struct {
+	sim *Simulation
+	// The cycles that can still be redone, oldest first.
+	frames []rollbackFrame
+	// The inputs for the next cycle.
+	next [2]string
+	// The oldest cycle that has to be redone because an input for it arrived late, or -1 if there isn't one.
+	redoFrom int
+	// The newest tag each player has sent. A player can't send an input for a cycle before one they've already sent.
+	acked [2]int
+}
+
+func NewRollback(sim *Simulation) *Rollback {
+	return &Rollback{sim: sim, frames: make([]rollbackFrame, 0, ROLLBACK_WINDOW+1), redoFrom: -1}
+}
+
+// first returns the tick of the oldest cycle that can still be redone.
+func (r *Rollback) first() int {
+	return r.sim.Tick - len(r.frames)
+}
+
+// Input takes a command from a player for the cycle after the given tick. Inputs without a tick, with a tick that hasn't happened yet,
+// or with one from too long ago are used for the next cycle. A "NONE" never replaces another command meant for the same cycle, since
+// clients send "NONE" whenever nothing is pressed and it could otherwise wipe out a real command that was tagged with the same tick.
+func (r *Rollback) Input(player int, tick int, command string) {
+	if tick <= 0 || tick > r.sim.Tick {
+		tick = r.sim.Tick
+	}
+	if tick < r.acked[player] {
+		tick = r.acked[player]
+	}
+	r.acked[player] = tick
+	slot := &r.next[player]
+	if tick >= r.first() && tick < r.sim.Tick {
+		slot = &r.frames[tick-r.first()].inputs[player]
+		if r.redoFrom < 0 || tick < r.redoFrom {
+			r.redoFrom = tick
+		}
+	}
+	if command != "NONE" || *slot == "" {
+		*slot = command
+	}
+}
+
+// DropInputs throws away the inputs for the next cycle. It's used while the battle is paused, so that nothing pressed during the pause
+// takes effect when it starts again.
+func (r *Rollback) DropInputs() {
+	r.next = [2]string{}
+}
+
+// Step redoes any cycles that late inputs changed and then simulates the next one, unless redoing them ended the match. It returns the
+// cycles that just became final, oldest first, and the first illegal state transition it ran into, if any.
+func (r *Rollback) Step() ([]rollbackFrame, error) {
+	var err error
+	if r.redoFrom >= 0 {
+		i := r.redoFrom - r.first()
+		*r.sim = r.frames[i].before
+		for ; i < len(r.frames); i++ {
+			// The later cycles start from a different state now too.
+			r.frames[i].before = *r.sim
+			var stepErr error
+			r.frames[i].updates, stepErr = r.sim.Step(r.frames[i].inputs)
+			err = firstError(err, stepErr)
+			// If the late input made the match end sooner, the cycles after this one never happened.
+			if r.sim.Over() {
+				r.frames = r.frames[:i+1]
+				break
+			}
+		}
+		r.redoFrom = -1
+	}
+	if r.sim.Over() {
+		r.next = [2]string{}
+		return nil, err
+	}
+	frame := rollbackFrame{before: *r.sim, inputs: r.next}
+	var stepErr error
+	frame.updates, stepErr = r.sim.Step(r.next)
+	r.frames = append(r.frames, frame)
+	r.next = [2]string{}
+
+	var final []rollbackFrame
+	if len(r.frames) > ROLLBACK_WINDOW {
+		final = append(final, r.frames[:len(r.frames)-ROLLBACK_WINDOW]...)
+		r.frames = append(r.frames[:0], r.frames[len(r.frames)-ROLLBACK_WINDOW:]...)
+	}
+	return final, firstError(err, stepErr)
+}
+
+// Flush makes every cycle final, for when the match is over, and returns the ones that weren't already.
+func (r *Rollback) Flush() []rollbackFrame {
+	final := append([]rollbackFrame(nil), r.frames...)
+	r.frames = r.frames[:0]
+	return final
+}
+
+// Updates returns what each player currently sees, including which of their inputs have arrived.
+func (r *Rollback) Updates() [2]Update {
+	updates := r.sim.Updates()
+	for p := range updates {
+		updates[p].Ack = r.acked[p]
+	}
+	return updates
+}
+
+func (r *Rollback) Over() bool {
+	return r.sim.Over()
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+// rollbackStep steps a Rollback and fails the test if the rules made an illegal state transition.
+func rollbackStep(t *testing.T, r *Rollback, cycles int) {
+	t.Helper()
+	for i := 0; i < cycles; i++ {
+		if _, err := r.Step(); err != nil {
+			t.Fatalf("tick %d: %v", r.sim.Tick, err)
+		}
+	}
+}
+
+// onTime plays the match the way it would have gone if a light attack from player 1 had arrived on time, for the cycle after the
+// given tick, and returns it at the given tick.
+func onTime(t *testing.T, lightAfter, until int) *Simulation {
+	t.Helper()
+	sim := newTestSimulation(1)
+	wait(t, sim, lightAfter)
+	step(t, sim, [2]string{"LIGHT", ""})
+	wait(t, sim, until-lightAfter-1)
+	return sim
+}
+
+func TestLateInputRedoesTheCyclesAfterIt(t *testing.T) {
+	r := NewRollback(newTestSimulation(1))
+	rollbackStep(t, r, 10)
+	r.Input(0, 5, "LIGHT")
+	rollbackStep(t, r, 1)
+	want := onTime(t, 5, 11)
+	if r.sim.Updates() != want.Updates() {
+		t.Fatalf("after the late input the match is %+v, but on time it would be %+v", r.sim.Updates(), want.Updates())
+	}
+	if frame := r.frames[5-r.first()]; frame.before.Tick != 5 || frame.inputs[0] != "LIGHT" || frame.updates[0].Self.State != LightAttack {
+		t.Fatalf("the cycle after tick 5 should have been redone with the light attack: %+v", frame)
+	}
+	if r.Updates()[0].Ack != 5 {
+		t.Fatalf("player 1's ack is %d", r.Updates()[0].Ack)
+	}
+}
+
+func TestNoneDoesntReplaceACommand(t *testing.T) {
+	r := NewRollback(newTestSimulation(1))
+	rollbackStep(t, r, 10)
+	r.Input(0, 5, "LIGHT")
+	r.Input(0, 5, "NONE")
+	rollbackStep(t, r, 1)
+	if want := onTime(t, 5, 11); r.sim.Updates() != want.Updates() {
+		t.Fatalf("the NONE should have been ignored: %+v, want %+v", r.sim.Updates(), want.Updates())
+	}
+
+	r.Input(1, 0, "HEAVY")
+	r.Input(1, 0, "NONE")
+	if r.next[1] != "HEAVY" {
+		t.Fatalf("the input for the next cycle is %q", r.next[1])
+	}
+	// A NONE does count when nothing else was sent, since that's how a block is let go of.
+	r.Input(0, 0, "NONE")
+	if r.next[0] != "NONE" {
+		t.Fatalf("the input for the next cycle is %q", r.next[0])
+	}
+}
+
+func TestInputsBeforeTheAckGoToTheNextCycle(t *testing.T) {
+	r := NewRollback(newTestSimulation(1))
+	rollbackStep(t, r, 10)
+	r.Input(0, 10, "BLOCK")
+	// Player 1 has already sent an input for the cycle after tick 10, so this can't be for an earlier one.
+	r.Input(0, 5, "LIGHT")
+	if r.redoFrom != -1 || r.next[0] != "LIGHT" || r.Updates()[0].Ack != 10 {
+		t.Fatalf("the input should be for the next cycle: redo from %d, next %v, ack %d", r.redoFrom, r.next, r.Updates()[0].Ack)
+	}
+	for _, frame := range r.frames {
+		if frame.inputs[0] != "" {
+			t.Fatalf("the cycle after tick %d got input %q", frame.before.Tick, frame.inputs[0])
+		}
+	}
+}
+
+func TestInputsOlderThanTheWindowGoToTheNextCycle(t *testing.T) {
+	r := NewRollback(newTestSimulation(1))
+	rollbackStep(t, r, 2*ROLLBACK_WINDOW)
+	r.Input(1, 2, "HEAVY")
+	if r.redoFrom != -1 || r.next[1] != "HEAVY" {
+		t.Fatalf("the input should be for the next cycle: redo from %d, next %v", r.redoFrom, r.next)
+	}
+	rollbackStep(t, r, 1)
+	if state := r.sim.Players[1].State; state != HeavyAttack {
+		t.Fatalf("the heavy attack should have started on the next cycle, state is %v", state)
+	}
+	// The oldest cycle that can still be redone is the one right at the edge of the window.
+	r.Input(0, r.first(), "LIGHT")
+	if r.redoFrom != r.first() {
+		t.Fatalf("an input for tick %d should be redone from there, redo from is %d", r.first(), r.redoFrom)
+	}
+}
+
+func TestLateInputThatEndsTheMatchStopsTheRedo(t *testing.T) {
+	rules := DefaultRules()
+	rules.StartingLife = rules.LightAttackDamage
+	r := NewRollback(NewSimulation(1, &rules))
+	// Player 2 blocks player 1's light attack...
+	r.Input(1, 0, "BLOCK")
+	rollbackStep(t, r, 20)
+	r.Input(0, 0, "LIGHT")
+	rollbackStep(t, r, 1)
+	for r.sim.Players[0].State == LightAttack {
+		rollbackStep(t, r, 1)
+	}
+	landed := r.sim.Tick
+	rollbackStep(t, r, 3)
+	if r.Over() || r.sim.Players[1].Life != rules.StartingLife {
+		t.Fatalf("the blocked attack shouldn't have ended the match: %+v", r.sim.Players[1])
+	}
+	// ...but it turns out they let go of the block just before it landed, so it ended the match.
+	r.Input(1, landed-4, "NONE")
+	final, err := r.Step()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Over() || r.sim.Wins != [2]int{1, 0} || r.sim.Tick != landed {
+		t.Fatalf("the match should have ended at tick %d with one win for player 1: over %v, tick %d, wins %v", landed, r.Over(), r.sim.Tick,
+			r.sim.Wins)
+	}
+	if len(final) != 0 || r.first()+len(r.frames) != landed || r.frames[len(r.frames)-1].updates[1].Self.Life > 0 {
+		t.Fatalf("the cycles after the match ended should be gone: %d final, %d left starting at tick %d", len(final), len(r.frames), r.first())
+	}
+	// Stepping an ended match changes nothing.
+	rollbackStep(t, r, 5)
+	if r.sim.Tick != landed || r.sim.Wins != [2]int{1, 0} {
+		t.Fatalf("the match went on after it ended: tick %d, wins %v", r.sim.Tick, r.sim.Wins)
+	}
+}
@@ -0,0 +1,260 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Everyone starts out in this room, and goes back to it when they leave another room. It's never deleted.
+const LOBBY_ROOM string = "lobby"
+
+// A Room is a group of users that chat together and get matched against each other when they ready up. Queue holds the members who
+// are ready for a game, in the order they readied. Matches started in the room are played under its Rules.
+type Room struct {
+	Name    string
+	Members map[*ConnInfo]bool
+	Queue   []*ConnInfo
+	Rules   *Rules
+}
+
+func NewRoom(name string, rules *Rules) *Room {
+	return &Room{Name: name, Members: make(map[*ConnInfo]bool), Queue: make([]*ConnInfo, 0), Rules: rules}
+}
+
+// lobby is everything the dispatcher keeps track of. It's only ever used from the dispatcher goroutine, so no mutex is needed.
+type lobby struct {
+	clients map[*ConnInfo]*User
+	// Every session by its token, so that reconnecting clients can resume theirs.
+	sessions map[string]*ConnInfo
+	rooms    map[string]*Room
+	// Matches that have been started, by ID. Finished matches are removed lazily by listMatches.
+	matches     map[int]*Match
+	nextMatchID int
+	// Ratings by username, and the channel battles report their results through.
+	ratings map[string]*Rating
+	results chan MatchResult
+	// Finished matches are saved here, and training recordings here.
+	store      Store
+	recordings *Recordings
+	// The rulesets rooms can choose between, by name.
+	rulesets map[string]*Rules
+	// Matches whose results haven't been saved yet, and whether the server is shutting down. See shutdown.go.
+	running  map[*Match]bool
+	draining bool
+	shutdown *Shutdown
+}
+
+func newLobby(store Store, recordings *Recordings, rulesets map[string]*Rules, shutdown *Shutdown) *lobby {
+	l := &lobby{
+		store:       store,
+		recordings:  recordings,
+		rulesets:    rulesets,
+		shutdown:    shutdown,
+		running:     make(map[*Match]bool),
+		clients:     make(map[*ConnInfo]*User),
+		sessions:    make(map[string]*ConnInfo),
+		rooms:       make(map[string]*Room),
+		matches:     make(map[int]*Match),
+		nextMatchID: 1,
+		ratings:     make(map[string]*Rating),
+		results:     make(chan MatchResult),
+	}
+	l.rooms[LOBBY_ROOM] = NewRoom(LOBBY_ROOM, rulesets[DEFAULT_RULES])
+	if err := l.loadRatings(); err != nil {
+		logError("failed to load ratings, so everyone starts over:", err)
+	}
+	return l
+}
+
+// broadcast sends a message to everyone in a room.
+func (l *lobby) broadcast(room *Room, msg Envelope) {
+	for conn := range room.Members {
+		conn.Outbound <- msg
+	}
+}
+
+// findUser returns the connection of the user with the given name, or nil if nobody by that name is connected.
+func (l *lobby) findUser(name string) *ConnInfo {
+	for conn, user := range l.clients {
+		if name != "" && user.Name == name {
+			return conn
+		}
+	}
+	return nil
+}
+
+func (l *lobby) ready(conn *ConnInfo) {
+	user := l.clients[conn]
+	if user.Ready {
+		return
+	}
+	user.Ready = true
+	user.ReadySince = time.Now()
+	user.Room.Queue = append(user.Room.Queue, conn)
+}
+
+func (l *lobby) unready(conn *ConnInfo) {
+	user := l.clients[conn]
+	user.Ready = false
+	for i, queued := range user.Room.Queue {
+		if queued == conn {
+			user.Room.Queue = append(user.Room.Queue[:i], user.Room.Queue[i+1:]...)
+			break
+		}
+	}
+}
+
+// joinRoom puts a user in the named room, which must already exist.
+func (l *lobby) joinRoom(conn *ConnInfo, name string) {
+	room := l.rooms[name]
+	room.Members[conn] = true
+	l.clients[conn].Room = room
+}
+
+// leaveRoom takes a user out of their room. Rooms other than the lobby are deleted once the last member leaves.
+func (l *lobby) leaveRoom(conn *ConnInfo) {
+	user := l.clients[conn]
+	if user.Room == nil {
+		return
+	}
+	l.unready(conn)
+	delete(user.Room.Members, conn)
+	if len(user.Room.Members) == 0 && user.Room.Name != LOBBY_ROOM {
+		delete(l.rooms, user.Room.Name)
+	}
+	user.Room = nil
+}
+
+// switchRoom moves a user to another existing room. It returns a message for the user saying what happened.
+func (l *lobby) switchRoom(conn *ConnInfo, name string) string {
+	if _, ok := l.rooms[name]; !ok {
+		return "There is no room called " + name + "."
+	}
+	l.leaveRoom(conn)
+	l.joinRoom(conn, name)
+	return "You are now in room " + name + "."
+}
+
+func (l *lobby) createRoom(conn *ConnInfo, name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "Rooms need a name."
+	}
+	if _, ok := l.rooms[name]; ok {
+		return "There is already a room called " + name + "."
+	}
+	l.rooms[name] = NewRoom(name, l.rulesets[DEFAULT_RULES])
+	return l.switchRoom(conn, name)
+}
+
+// setRules changes the ruleset of the user's room. The lobby always uses the default rules, so that everyone knows what they're
+// getting there.
+func (l *lobby) setRules(conn *ConnInfo, name string) string {
+	room := l.clients[conn].Room
+	rules, ok := l.rulesets[name]
+	if !ok {
+		return "There are no rules called " + name + ". " + listRulesets(l.rulesets)
+	}
+	if room.Name == LOBBY_ROOM {
+		return "The lobby always uses the " + DEFAULT_RULES + " rules. Create a room to use others."
+	}
+	room.Rules = rules
+	l.broadcast(room, serverMessage(displayName(l.clients[conn].Name)+" changed the rules for this room to "+name+"."))
+	return ""
+}
+
+// listRooms describes every room and how many people are in it.
+func (l *lobby) listRooms() string {
+	names := make([]string, 0, len(l.rooms))
+	for name := range l.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	description := "Rooms:"
+	for _, name := range names {
+		room := l.rooms[name]
+		description += " [" + name + ": " + pluralize(len(room.Members), "user") + ", " + strconv.Itoa(len(room.Queue)) + " ready, " + room.Rules.Name + " rules]"
+	}
+	return description
+}
+
+// invite tells another user about the room the inviter is in.
+func (l *lobby) invite(conn *ConnInfo, name string) string {
+	invitee := l.findUser(name)
+	if invitee == nil {
+		return "There is nobody called " + name + " online."
+	}
+	room := l.clients[conn].Room
+	invitee.Outbound <- serverMessage(displayName(l.clients[conn].Name) + " invited you to room " + room.Name + ". Type /join " + room.Name + " to go there.")
+	return "You invited " + name + " to room " + room.Name + "."
+}
+
+// challenge asks another user for a match. The match only starts if they accept.
+func (l *lobby) challenge(conn *ConnInfo, name string) string {
+	challenged := l.findUser(name)
+	if challenged == nil {
+		return "There is nobody called " + name + " online."
+	}
+	if challenged == conn {
+		return "You can't challenge yourself."
+	}
+	if l.clients[challenged].InGame {
+		return name + " is in a match right now."
+	}
+	challenger := displayName(l.clients[conn].Name)
+	l.clients[challenged].Challengers[conn] = true
+	challenged.Outbound <- serverMessage(challenger + " challenged you to a match under the " + l.clients[conn].Room.Rules.Name + " rules. Type /accept " + challenger + " or /decline " + challenger + ".")
+	return "You challenged " + name + "."
+}
+
+// findChallenger returns the connection of the user with the given name if they have challenged conn, or nil if they haven't.
+func (l *lobby) findChallenger(conn *ConnInfo, name string) *ConnInfo {
+	for challenger := range l.clients[conn].Challengers {
+		if _, ok := l.clients[challenger]; !ok {
+			// They've disconnected since.
+			delete(l.clients[conn].Challengers, challenger)
+		} else if displayName(l.clients[challenger].Name) == name {
+			return challenger
+		}
+	}
+	return nil
+}
+
+func (l *lobby) accept(conn *ConnInfo, name string) string {
+	challenger := l.findChallenger(conn, name)
+	if challenger == nil {
+		return name + " hasn't challenged you."
+	}
+	delete(l.clients[conn].Challengers, challenger)
+	if l.clients[challenger].InGame {
+		return name + " is in a match right now."
+	}
+	// Challenges are played under the rules of the challenger's room.
+	l.startMatch(challenger, conn, l.clients[challenger].Room.Rules)
+	return ""
+}
+
+func (l *lobby) decline(conn *ConnInfo, name string) string {
+	challenger := l.findChallenger(conn, name)
+	if challenger == nil {
+		return name + " hasn't challenged you."
+	}
+	delete(l.clients[conn].Challengers, challenger)
+	challenger.Outbound <- serverMessage(displayName(l.clients[conn].Name) + " declined your challenge.")
+	return "You declined " + name + "'s challenge."
+}
+
+// pluralize formats a count of something, like "1 user" or "3 users".
+func pluralize(count int, thing string) string {
+	if count == 1 {
+		return "1 " + thing
+	}
+	return strconv.Itoa(count) + " " + thing + "s"
+}
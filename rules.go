@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Rulesets are loaded from the .json files in this directory when the server starts.
+var RULES_DIR string = "rules"
+
+// Rooms use this ruleset unless they pick another one. It always exists, even if there's no file for it.
+const DEFAULT_RULES string = "classic"
+
+// Rules holds every number that affects how a battle plays out. Durations are in mainloop cycles, which are 1 centisecond each.
+type Rules struct {
+	Name                     string  `json:"name"`
+	StartingLife             int     `json:"startingLife"`
+	StartingStamina          float32 `json:"startingStamina"`
+	MaxStamina               float32 `json:"maxStamina"`
+	StaminaRegen             float32 `json:"staminaRegen"`
+	LightAttackDamage        int     `json:"lightAttackDamage"`
+	LightAttackSpeed         int     `json:"lightAttackSpeed"`
+	LightAttackCost          float32 `json:"lightAttackCost"`
+	LightAttackBlockCost     float32 `json:"lightAttackBlockCost"`
+	CounterattackSpeed       int     `json:"counterattackSpeed"`
+	CounterattackDamage      int     `json:"counterattackDamage"`
+	HeavyAttackDamage        int     `json:"heavyAttackDamage"`
+	HeavyAttackSpeed         int     `json:"heavyAttackSpeed"`
+	HeavyAttackCost          float32 `json:"heavyAttackCost"`
+	HeavyAttackBlockCost     float32 `json:"heavyAttackBlockCost"`
+	HeavyAttackBlockedDamage int     `json:"heavyAttackBlockedDamage"`
+	DodgeCost                float32 `json:"dodgeCost"`
+	DodgeWindow              int     `json:"dodgeWindow"`
+	// A match is best of this many rounds, and each round ends after RoundTime cycles. A RoundTime of 0 means there's no time limit.
+	Rounds    int `json:"rounds"`
+	RoundTime int `json:"roundTime"`
+}
+
+// DefaultRules returns the classic rules, which are the ones described in the README. Fields left out of a ruleset file take these
+// values.
+func DefaultRules() Rules {
+	return Rules{
+		Name:                     DEFAULT_RULES,
+		StartingLife:             100,
+		StartingStamina:          100,
+		MaxStamina:               100,
+		StaminaRegen:             0.1,
+		LightAttackDamage:        3,
+		LightAttackSpeed:         50,
+		LightAttackCost:          10.0,
+		LightAttackBlockCost:     12.0,
+		CounterattackSpeed:       30,
+		CounterattackDamage:      3,
+		HeavyAttackDamage:        6,
+		HeavyAttackSpeed:         100,
+		HeavyAttackCost:          15.0,
+		HeavyAttackBlockCost:     20.0,
+		HeavyAttackBlockedDamage: 2,
+		DodgeCost:                20.0,
+		DodgeWindow:              30,
+		Rounds:                   1,
+		RoundTime:                9000,
+	}
+}
+
+// Validate checks that the rules make for a playable battle.
+func (r *Rules) Validate() error {
+	problems := make([]string, 0)
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+	check(r.Name != "" && !strings.ContainsAny(r.Name, " \t\n"), "name must be non-empty and have no spaces")
+	check(r.StartingLife > 0, "startingLife must be positive")
+	check(r.MaxStamina > 0, "maxStamina must be positive")
+	check(r.StartingStamina >= 0 && r.StartingStamina <= r.MaxStamina, "startingStamina must be between 0 and maxStamina")
+	check(r.StaminaRegen >= 0, "staminaRegen can't be negative")
+	check(r.LightAttackDamage >= 0, "lightAttackDamage can't be negative")
+	check(r.LightAttackSpeed > 0, "lightAttackSpeed must be positive")
+	check(r.LightAttackCost >= 0 && r.LightAttackCost <= r.MaxStamina, "lightAttackCost must be between 0 and maxStamina")
+	check(r.LightAttackBlockCost >= 0, "lightAttackBlockCost can't be negative")
+	check(r.CounterattackSpeed > 0, "counterattackSpeed must be positive")
+	check(r.CounterattackDamage >= 0, "counterattackDamage can't be negative")
+	check(r.HeavyAttackDamage >= 0, "heavyAttackDamage can't be negative")
+	// Light attacks have to be able to land before a heavy attack does, or heavy attacks could never be interrupted.
+	check(r.HeavyAttackSpeed > r.LightAttackSpeed, "heavyAttackSpeed must be greater than lightAttackSpeed")
+	check(r.HeavyAttackCost >= 0 && r.HeavyAttackCost <= r.MaxStamina, "heavyAttackCost must be between 0 and maxStamina")
+	check(r.HeavyAttackBlockCost >= 0, "heavyAttackBlockCost can't be negative")
+	check(r.HeavyAttackBlockedDamage >= 0, "heavyAttackBlockedDamage can't be negative")
+	check(r.DodgeCost >= 0 && r.DodgeCost <= r.MaxStamina, "dodgeCost must be between 0 and maxStamina")
+	check(r.DodgeWindow >= 0, "dodgeWindow can't be negative")
+	check(r.Rounds > 0, "rounds must be positive")
+	check(r.RoundTime >= 0, "roundTime can't be negative")
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid rules %q: %s", r.Name, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// LoadRules reads a single ruleset file. Anything the file leaves out is taken from the classic rules, and the name defaults to the
+// name of the file.
+func LoadRules(path string) (*Rules, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rules := DefaultRules()
+	rules.Name = strings.TrimSuffix(filepath.Base(path), ".json")
+	decoder := json.NewDecoder(file)
+	// Misspelled fields would otherwise be silently ignored.
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &rules, nil
+}
+
+// LoadRulesets loads every ruleset in a directory. The classic rules are always included, but a classic.json file can change them.
+// A missing directory just means there's nothing but the classic rules.
+func LoadRulesets(dir string) (map[string]*Rules, error) {
+	classic := DefaultRules()
+	rulesets := map[string]*Rules{DEFAULT_RULES: &classic}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return rulesets, nil
+	} else if err != nil {
+		return nil, err
+	}
+	loaded := make(map[string]string)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		rules, err := LoadRules(path)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := loaded[rules.Name]; ok {
+			return nil, fmt.Errorf("%s and %s both define rules %q", other, path, rules.Name)
+		}
+		loaded[rules.Name] = path
+		rulesets[rules.Name] = rules
+	}
+	return rulesets, nil
+}
+
+// listRulesets describes the rulesets rooms can choose between.
+func listRulesets(rulesets map[string]*Rules) string {
+	names := make([]string, 0, len(rulesets))
+	for name := range rulesets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "Rulesets: " + strings.Join(names, ", ")
+}
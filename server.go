@@ -6,195 +6,471 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-// Messages are the JSON objects used for most communication between clients and the server. In the case of a chat message, Content will be used and Command will be left blank. In the context of a special message, Command will be used and Content will be left blank.
-type Message struct {
-	Username string `json:"username"`
-	Content  string `json:"message"`
-	Command  string `json:"command"`
-}
+// Once the matches have finished, open HTTP requests get this long to finish too before the server stops.
+const HTTP_SHUTDOWN_TIMEOUT time.Duration = 10 * time.Second
 
 // The two channels in this struct are for the player sending commands to the server and for the server sending gamestate updates to the player's computer.
+// Name is the account the user logged in to; whatever username the client puts in its messages is ignored. Spectating is the match the user is watching, if any, and SpectatorChan is where the updates for it arrive.
+// Room is the room the user is in, and Challengers holds everyone who has challenged the user and hasn't been answered yet.
+// ReadySince is when the user last readied, which the matchmaker uses to decide how picky to be about their opponent's rating.
+// Match is the match the user is fighting or last fought, and Side is whether they're player 1 (0) or player 2 (1) in it.
 type User struct {
+	Name             string
 	Ready            bool
+	ReadySince       time.Time
 	InGame           bool
-	BattleInputChan  chan Message
+	BattleInputChan  chan BattleInput
 	BattleUpdateChan chan Update
+	Spectating       *Match
+	SpectatorChan    chan SpectatorUpdate
+	Room             *Room
+	Challengers      map[*ConnInfo]bool
+	Match            *Match
+	Side             int
 }
 
 // ConnInfo models the communication channel between a user's client and the
-// server.
+// server. It lasts for the user's whole session, which can outlive any one
+// websocket: if the websocket drops, the client can reconnect with Token and
+// pick up where it left off. Outbound is never closed, and anything sent to it
+// while the client is disconnected is thrown away. See session.go.
 type ConnInfo struct {
-	Inbound  chan Message
-	Outbound chan interface{}
+	Outbound chan Envelope
+	Token    string
+	// The websocket that's attached right now and when the last one dropped. Only the dispatcher uses these.
+	socket         *Socket
+	disconnectedAt time.Time
+	attach         chan *Socket
+	expired        chan bool
 }
 
-// MessageInfo wraps a Message with a reference to the User that sent it.
+// MessageInfo wraps a Request with a reference to the User that sent it and the connection it came from.
 type MessageInfo struct {
-	Message Message
+	Request Request
 	User    *User
+	Conn    *ConnInfo
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "league" {
+		if err := runLeague(os.Args[2:]); err != nil && err != flag.ErrHelp {
+			log.Fatal(err)
+		}
+		return
+	}
+	config, err := LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	config.Apply()
 	// When new clients arrive, their IO channels will be sent through here.
-	var newClients = make(chan ConnInfo)
-	go dispatcher(newClients)
-	fs := http.FileServer(http.Dir("./"))
+	var newClients = make(chan *Socket)
+	rulesets, err := LoadRulesets(RULES_DIR)
+	if err != nil {
+		log.Fatal("failed to load rules: ", err)
+	}
+	logInfo("loaded", listRulesets(rulesets))
+	store, err := OpenFileStore(MATCH_STORE_PATH)
+	if err != nil {
+		log.Fatal("failed to open match store: ", err)
+	}
+	defer store.Close()
+	accounts, err := OpenAccounts(ACCOUNT_STORE_PATH)
+	if err != nil {
+		log.Fatal("failed to open accounts: ", err)
+	}
+	defer accounts.Close()
+	recordings, err := OpenRecordings(RECORDING_STORE_PATH)
+	if err != nil {
+		log.Fatal("failed to open recordings: ", err)
+	}
+	defer recordings.Close()
+	shutdown := NewShutdown()
+	// The health check and metrics ask the dispatcher how the lobby is doing through here.
+	statsRequests := make(chan chan LobbyStats)
+	go dispatcher(newClients, store, recordings, rulesets, shutdown, statsRequests)
+	// Only the web client is served, not the server's own files.
+	fs := http.FileServer(http.Dir(config.StaticDir))
 	http.Handle("/", fs)
+	upgrader := config.Upgrader()
 	// handleConnection actually returns an anonymous function that handles connections.
-	http.Handle("/ws", handleConnection(newClients))
-	port := ":8000"
-	log.Println("http server starting on port", port)
-	err := http.ListenAndServe(port, nil)
-	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+	http.Handle("/ws", handleConnection(newClients, accounts, upgrader, shutdown))
+	http.Handle("/replays", listReplays())
+	http.Handle("/replay", streamReplay(upgrader, shutdown))
+	http.Handle("/api/history", serveHistory(store))
+	http.Handle("/api/stats", serveStats(store))
+	http.Handle("/api/recordings", serveRecordings(recordings))
+	http.Handle("/api/register", serveRegister(accounts))
+	http.Handle("/api/login", serveLogin(accounts))
+	http.Handle("/api/logout", serveLogout(accounts))
+	http.Handle("/api/me", serveMe(accounts))
+	http.Handle("/healthz", serveHealth(statsRequests))
+	http.Handle("/metrics", serveMetrics(statsRequests))
+	logInfo("http server starting on", config.Listen, "serving", config.StaticDir, "with data in", config.DataDir)
+	server := config.Server(nil)
+	go func() {
+		if err := config.ListenAndServe(server); err != http.ErrServerClosed {
+			log.Fatal("ListenAndServe: ", err)
+		}
+	}()
+
+	// Wait to be told to stop, and then give the matches in progress a chance to finish first.
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	logInfo("shutting down; waiting up to", config.ShutdownTimeout, "for matches to finish")
+	go func() {
+		<-signals
+		log.Fatal("stopped without waiting for matches")
+	}()
+	shutdown.Run(config.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), HTTP_SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logWarn("http server shutdown:", err)
+	}
+	if err := shutdown.CloseSockets(ctx); err != nil {
+		logWarn("websockets still open:", err)
 	}
+	logInfo("server stopped")
 }
 
 // dispatcher takes a channel to receive new clients on and coordinates
 // high-level message passing. It alone has the list of all connected clients,
-// so no mutex is needed. Because it only takes in ConnInfos, it doesn't care
+// so no mutex is needed. Because it only takes in Sockets, it doesn't care
 // how the clients are connected.
-func dispatcher(newClients <-chan ConnInfo) {
-	// The list of clients never leaves this scope.
-	var clients = make(map[*ConnInfo]*User)
+func dispatcher(newClients <-chan *Socket, store Store, recordings *Recordings, rulesets map[string]*Rules, shutdown *Shutdown, statsRequests <-chan chan LobbyStats) {
+	// The list of clients, rooms and matches never leaves this scope.
+	var l = newLobby(store, recordings, rulesets, shutdown)
 	// All incoming messages will be merged into this channel.
 	var messages = make(chan MessageInfo)
-	// This is used for clients that disconnect, so they can be removed.
-	var leaving = make(chan *ConnInfo)
+	// This is used for clients that disconnect, so their sessions can be put on hold.
+	var leaving = make(chan departure)
+	// Ready players whose rating gap was too big might be matchable after waiting a while.
+	var matchTicker = time.NewTicker(MATCHMAKER_INTERVAL)
+	defer matchTicker.Stop()
+	// Clients that don't come back in time are removed.
+	var sessionTicker = time.NewTicker(SESSION_CHECK_INTERVAL)
+	defer sessionTicker.Stop()
+	// These are set to nil once they've been closed, so that they're only acted on once.
+	var draining, stopping = shutdown.draining, shutdown.stopping
 	for {
 		select {
-		// When a new connection is established.
-		case newConn := <-newClients:
-			// Add them to the list.
-			user := User{false, false, make(chan Message), make(chan Update)}
-			clients[&newConn] = &user
-
-			// Merge their Messages ino the single messages channel.
-			go func(sink chan<- MessageInfo, conn *ConnInfo, user *User,
-				leaving chan<- *ConnInfo) {
-				for m := range conn.Inbound {
-					// Associate the Message with the User so we can tell who
-					// sent it later.
-					sink <- MessageInfo{Message: m, User: user}
-				}
-				// Let dispatch know that they're gone before we exit.
-				leaving <- conn
-			}(messages, &newConn, &user, leaving)
+		// When a new connection is established, start a session for it or resume the one it asked for.
+		case newSocket := <-newClients:
+			l.attachSocket(newSocket, messages, leaving)
+
+		case <-matchTicker.C:
+			for _, room := range l.rooms {
+				l.matchmaker(room)
+			}
+
+		// Adjust ratings when a match ends.
+		case result := <-l.results:
+			l.recordResult(result)
+			delete(l.running, result.Match)
+			l.checkDrained()
 
-		// Delete clients when they disconnect.
-		case oldConn := <-leaving:
-			delete(clients, oldConn)
+		// When the server is shutting down, let the matches in progress finish, and then stop any that take too long.
+		case <-draining:
+			draining = nil
+			l.drain()
+		case <-stopping:
+			stopping = nil
+			l.stopMatches()
 
-		// When a Message is received from anyone.
+		// Hold on to clients when they disconnect, in case they come back.
+		case gone := <-leaving:
+			l.detachSocket(gone)
+
+		case now := <-sessionTicker.C:
+			l.expireSessions(now)
+
+		case reply := <-statsRequests:
+			reply <- l.stats()
+
+		// When a Request is received from anyone.
 		case msg := <-messages:
-			// If they're in a game, forward all messages there.
-			if msg.User.InGame {
-				log.Println(msg.Message)
-				if msg.Message.Command == "END MATCH" {
-					msg.User.InGame = false
-				} else {
-					msg.User.BattleInputChan <- msg.Message
-				}
+			l.handleRequest(msg)
+		}
+	}
+}
 
-				// Handle lobby command messages.
-			} else if msg.Message.Command != "" {
-				switch msg.Message.Command {
-				case "READY":
-					msg.User.Ready = true
-					// Try to start a match.
-					matchmaker(clients)
-				case "UNREADY":
-					msg.User.Ready = false
-				default:
-					log.Println("got unexpected message", msg.Message.Command, "from user", msg.Message.Username)
-				}
-				// Handle lobby chat messages.
-			} else {
-				for conn := range clients {
-					conn.Outbound <- msg.Message
-				}
-			}
+// handleRequest acts on a Request from a user. Requests have already been checked against the protocol by handleConnection, so all
+// that's left to check is whether the user can do what they asked right now.
+func (l *lobby) handleRequest(msg MessageInfo) {
+	request := msg.Request
+	switch request.Type {
+	// Chat messages only go to people in the same room, and they're always from the account the sender logged in to.
+	case TYPE_CHAT:
+		l.broadcast(msg.User.Room, NewEnvelope(TYPE_CHAT, Chat{From: msg.User.Name, Text: request.Chat.Text}))
+	case TYPE_INPUT:
+		if !msg.User.InGame {
+			msg.Conn.Outbound <- errorEnvelope(protocolError(ERROR_NOT_ALLOWED, request.Type, "you aren't in a match"))
+			return
+		}
+		// Players stay in a match until they end it, but the battle stops taking their inputs soon after it's over.
+		if msg.User.Match.Over() {
+			msg.Conn.Outbound <- errorEnvelope(protocolError(ERROR_NOT_ALLOWED, request.Type, "your match is over"))
+			return
+		}
+		// The battle can end before it takes the input, and then nothing ever would.
+		select {
+		case msg.User.BattleInputChan <- BattleInput{Command: request.Input.Input, Tick: request.Input.Tick}:
+		case <-msg.User.Match.Done:
+		}
+	case TYPE_COMMAND:
+		// Players in a match can't do anything in the lobby until they've seen how it ended.
+		training := msg.User.InGame && msg.User.Match.Training != nil
+		if msg.User.InGame && request.Command.Command == "END MATCH" {
+			msg.User.InGame = false
+		} else if training && TRAINING_COMMANDS[request.Command.Command] {
+			l.handleTrainingCommand(msg)
+		} else if TRAINING_COMMANDS[request.Command.Command] {
+			msg.Conn.Outbound <- errorEnvelope(protocolError(ERROR_NOT_ALLOWED, request.Type, "%s can only be used during training", request.Command.Command))
+		} else if msg.User.InGame {
+			msg.Conn.Outbound <- errorEnvelope(protocolError(ERROR_NOT_ALLOWED, request.Type, "%s can't be used during a match", request.Command.Command))
+		} else {
+			l.handleCommand(msg)
 		}
 	}
 }
 
-// This function is called whenever a new player readies for battle. If at least two people are ready for battle, it matches two of them.
-func matchmaker(clients map[*ConnInfo]*User) {
-	readyUsers := make([]*ConnInfo, 0)
-	for socket, user := range clients {
-		if user.Ready == true {
-			readyUsers = append(readyUsers, socket)
-		}
-	}
-	if len(readyUsers) >= 2 {
-		clients[readyUsers[0]].Ready = false
-		clients[readyUsers[0]].InGame = true
-		clients[readyUsers[1]].Ready = false
-		clients[readyUsers[1]].InGame = true
-		readyUsers[0].Outbound <- Message{Username: "", Content: "", Command: "START GAME"}
-		readyUsers[1].Outbound <- Message{Username: "", Content: "", Command: "START GAME"}
-		go battle(clients[readyUsers[0]].BattleInputChan, clients[readyUsers[1]].BattleInputChan, clients[readyUsers[0]].BattleUpdateChan, clients[readyUsers[1]].BattleUpdateChan)
-		go forwardUpdates(readyUsers[0].Outbound, clients[readyUsers[0]].BattleUpdateChan)
-		go forwardUpdates(readyUsers[1].Outbound, clients[readyUsers[1]].BattleUpdateChan)
+// handleCommand carries out a lobby command from a user who isn't in a match.
+func (l *lobby) handleCommand(msg MessageInfo) {
+	var reply string
+	if l.draining && MATCH_COMMANDS[msg.Request.Command.Command] {
+		msg.Conn.Outbound <- serverMessage("The server is shutting down, so no new matches can start.")
+		return
+	}
+	switch msg.Request.Command.Command {
+	case "READY":
+		stopSpectating(msg.User)
+		l.ready(msg.Conn)
+		// Try to start a match.
+		l.matchmaker(msg.User.Room)
+	case "UNREADY":
+		l.unready(msg.Conn)
+	case "LIST MATCHES":
+		reply = listMatches(l.matches)
+	case "SPECTATE":
+		reply = startSpectating(msg.User, msg.Conn, l.matches, msg.Request.Command.Argument)
+	case "STOP SPECTATING":
+		stopSpectating(msg.User)
+	case "RATINGS":
+		reply = l.listRatings(msg.Request.Command.Argument)
+	case "LIST RULES":
+		reply = listRulesets(l.rulesets)
+	case "SET RULES":
+		reply = l.setRules(msg.Conn, msg.Request.Command.Argument)
+	case "LIST ROOMS":
+		reply = l.listRooms()
+	case "CREATE ROOM":
+		reply = l.createRoom(msg.Conn, msg.Request.Command.Argument)
+	case "JOIN ROOM":
+		reply = l.switchRoom(msg.Conn, msg.Request.Command.Argument)
+	case "LEAVE ROOM":
+		reply = l.switchRoom(msg.Conn, LOBBY_ROOM)
+	case "INVITE":
+		reply = l.invite(msg.Conn, msg.Request.Command.Argument)
+	case "CHALLENGE":
+		reply = l.challenge(msg.Conn, msg.Request.Command.Argument)
+	case "ACCEPT":
+		reply = l.accept(msg.Conn, msg.Request.Command.Argument)
+	case "DECLINE":
+		reply = l.decline(msg.Conn, msg.Request.Command.Argument)
+	case "PRACTICE":
+		reply = l.startPractice(msg.Conn, msg.Request.Command.Argument)
+	case "TRAINING":
+		reply = l.startTraining(msg.Conn, msg.Request.Command.Argument)
+	case "RECORDINGS":
+		owner := msg.Request.Command.Argument
+		if owner == "" {
+			owner = msg.User.Name
+		}
+		reply = l.listRecordings(owner)
+	case "END MATCH":
+		// They already left the match, or were never in one.
+	default:
+		msg.Conn.Outbound <- errorEnvelope(protocolError(ERROR_INVALID, TYPE_COMMAND, "there is no command %q", msg.Request.Command.Command))
+	}
+	if reply != "" {
+		msg.Conn.Outbound <- serverMessage(reply)
 	}
 }
 
+// This function is called whenever a player readies for battle, and periodically by the dispatcher. It matches ready players in the room against whoever is closest to their rating, for as long as there are pairs close enough to match.
+func (l *lobby) matchmaker(room *Room) {
+	for {
+		pair := l.pickPair(room, time.Now())
+		if pair == nil {
+			return
+		}
+		l.startMatch(pair[0], pair[1], room.Rules)
+	}
+}
+
+// startMatch takes two users out of whatever they were doing and starts a battle between them under the given rules.
+func (l *lobby) startMatch(player1, player2 *ConnInfo, rules *Rules) *Match {
+	players := [2]*ConnInfo{player1, player2}
+	for _, conn := range players {
+		user := l.clients[conn]
+		l.unready(conn)
+		stopSpectating(user)
+		// Any challenges they had pending are moot now.
+		for challenger := range user.Challengers {
+			delete(user.Challengers, challenger)
+		}
+		user.InGame = true
+	}
+	user1, user2 := l.clients[player1], l.clients[player2]
+	// Let each player know who they're up against.
+	player1.Outbound <- serverMessage("You are fighting " + displayName(user2.Name) + ", rated " + l.currentRating(user2.Name).String() + ".")
+	player2.Outbound <- serverMessage("You are fighting " + displayName(user1.Name) + ", rated " + l.currentRating(user1.Name).String() + ".")
+	player1.Outbound <- gameMessage(TYPE_START_GAME, rules)
+	player2.Outbound <- gameMessage(TYPE_START_GAME, rules)
+	match := NewMatch(l.nextMatchID, user1.Name, user2.Name, rules, l.results)
+	user1.Match, user1.Side = match, 0
+	user2.Match, user2.Side = match, 1
+	l.matches[match.ID] = match
+	l.running[match] = true
+	l.nextMatchID++
+	go battle(match, user1.BattleInputChan, user2.BattleInputChan, user1.BattleUpdateChan, user2.BattleUpdateChan)
+	go forwardUpdates(player1.Outbound, user1.BattleUpdateChan)
+	go forwardUpdates(player2.Outbound, user2.BattleUpdateChan)
+	// Someone who disconnected after challenging can still have their challenge accepted. They get the usual grace period to come back.
+	for _, conn := range players {
+		if conn.socket == nil {
+			tellBattle(l.clients[conn], false)
+		}
+	}
+	return match
+}
+
 // Each time a new user connects, a goroutine running the function that this one returns is created. It keeps track of the connection and sends chat data or game data back and forth.
-func handleConnection(newClients chan<- ConnInfo) http.Handler {
+// Only logged in players can connect. A client that lost its connection can resume its session by connecting with ?session=<token>, using the token it was sent before.
+func handleConnection(newClients chan<- *Socket, accounts *Accounts, upgrader *websocket.Upgrader, shutdown *Shutdown) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Upgrade initial GET request to a websocket
-		var upgrader = websocket.Upgrader{}
+		name, ok := loggedInUser(accounts, r)
+		if !ok {
+			http.Error(w, "not logged in", http.StatusUnauthorized)
+			return
+		}
+		if shutdown.refuse(w) {
+			return
+		}
+		// Upgrade initial GET request to a websocket. If it fails, the upgrader has already told the client why.
 		socket, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			log.Fatal(err)
+			logWarn("websocket upgrade failed:", err)
+			return
 		}
 		defer socket.Close()
-		// Send the connection info.
-		var conn = ConnInfo{
-			Inbound:  make(chan Message),
-			Outbound: make(chan interface{}),
+		shutdown.sockets.Add(1)
+		defer shutdown.sockets.Done()
+		version, versionErr := negotiateVersion(r)
+		if versionErr != nil {
+			rejectVersion(socket, r, versionErr)
+			return
+		}
+		encoding := negotiateEncoding(r)
+		writer := newSocketWriter(socket, encoding)
+		if err := writer.Write(welcome(version, encoding, name)); err != nil {
+			return
 		}
+		// Send the connection info.
+		var conn = NewSocket(name, r.URL.Query().Get("session"))
 		// This will let the consumer know that it's no longer active.
+		defer close(conn.Done)
 		defer close(conn.Inbound)
-		defer close(conn.Outbound)
 		// Signal that a new client has arrived.
 		newClients <- conn
 
-		// Connect the outbound channel to the websocket.
+		// Connect the outbound channel to the websocket. A client that can't take a message within the slow client timeout is hung
+		// up on, the same as one that lets too many pile up in its session's queue. Writing is closed once this goroutine stops.
+		writing := make(chan bool)
 		go func() {
-			for msg := range conn.Outbound {
-				var err = socket.WriteJSON(msg)
-				if err != nil {
-					log.Println(err)
+			defer close(writing)
+			for {
+				select {
+				case msg := <-conn.Outbound:
+					socket.SetWriteDeadline(time.Now().Add(OUTBOUND_POLICY.SlowClientTimeout))
+					if err := writer.Write(msg); err != nil {
+						logDebug("hanging up after a failed write:", err)
+						socket.Close()
+						return
+					}
+				case <-conn.Replaced:
+					// Hanging up makes the read loop below stop.
+					socket.Close()
+					return
+				case <-conn.Slow:
+					socket.Close()
+					return
+				case <-shutdown.closing:
+					// Messages that were already on their way, like the last update of a match, are sent before hanging up.
+					socket.SetWriteDeadline(time.Now().Add(OUTBOUND_POLICY.SlowClientTimeout))
+					for {
+						select {
+						case msg := <-conn.Outbound:
+							writer.Write(msg)
+						case <-time.After(HANG_UP_DELAY):
+							hangUp(socket)
+							return
+						}
+					}
+				case <-conn.Done:
+					return
 				}
-				//TODO remove them or just drop the message?
 			}
 		}()
 
 		// Connect the websocket to the inbound channel.
-		var msg Message
 		for {
 			// Read the next message from chat
-			socket.ReadJSON(&msg)
+			messageType, message, err := socket.ReadMessage()
 			if err != nil {
-				log.Printf("error: %v", err)
+				logDebug("error:", err)
 				return
 			}
-			conn.Inbound <- msg
+			request, protocolErr := ParseRequest(message)
+			if messageType != websocket.TextMessage {
+				protocolErr = protocolError(ERROR_MALFORMED, "", "messages must be sent as text")
+			}
+			// Bad messages are answered right away. The client stays connected, since it might just be a bug in one feature.
+			if protocolErr != nil {
+				REJECTED_MESSAGES.Inc(protocolErr.Code)
+				logWarn("rejected message from", displayName(name)+":", protocolErr)
+				select {
+				case conn.Outbound <- errorEnvelope(protocolErr):
+				case <-writing:
+				}
+				continue
+			}
+			MESSAGES.Inc(request.Type, request.Command.Command)
+			conn.Inbound <- request
 		}
 	})
 }
 
 // This goroutine listens for gamestate updates from battle.go and forwards them to the player.
-func forwardUpdates(dest chan interface{}, src chan Update) {
+func forwardUpdates(dest chan Envelope, src chan Update) {
 	for update := range src {
-		dest <- update
-		if update.Self.Life <= 0 || update.Enemy.Life <= 0 {
+		dest <- NewEnvelope(TYPE_UPDATE, update)
+		if update.Over {
 			return
 		}
 	}
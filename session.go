@@ -0,0 +1,250 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// How long a disconnected user has to reconnect before their session is thrown away. If they were fighting, the match is paused for
+// this long and then they forfeit.
+const RECONNECT_GRACE time.Duration = 30 * time.Second
+
+// How often the dispatcher looks for sessions whose grace period has run out.
+const SESSION_CHECK_INTERVAL time.Duration = time.Second
+
+// After a session expires, anything still being sent to it is thrown away for this long so that nothing gets stuck sending to it.
+const SESSION_DRAIN_TIME time.Duration = 5 * time.Second
+
+// A Socket is one websocket connection. handleConnection makes one for every websocket and sends it to the dispatcher, which attaches
+// it to a session. Name is the account the client is logged in to, and Token is the session the client asked to resume, if any.
+// Inbound is closed when the websocket disconnects, and Done is closed right after, so nothing is sent to Outbound once it's gone.
+// The dispatcher closes Replaced when another websocket resumes the same session, and the session's pump closes Slow when the client
+// can't keep up with what's sent to it. Either one makes handleConnection hang up.
+type Socket struct {
+	Name     string
+	Token    string
+	Inbound  chan Request
+	Outbound chan Envelope
+	Done     chan bool
+	Replaced chan bool
+	Slow     chan bool
+}
+
+func NewSocket(name, token string) *Socket {
+	return &Socket{
+		Name:     name,
+		Token:    token,
+		Inbound:  make(chan Request),
+		Outbound: make(chan Envelope),
+		Done:     make(chan bool),
+		Replaced: make(chan bool),
+		Slow:     make(chan bool),
+	}
+}
+
+// A departure is sent to the dispatcher when one of a session's websockets disconnects.
+type departure struct {
+	conn   *ConnInfo
+	socket *Socket
+}
+
+// A ConnectionChange tells a battle that one of its players lost their connection or got it back.
+type ConnectionChange struct {
+	Player    int
+	Connected bool
+}
+
+func newSessionToken() string {
+	token, err := newToken()
+	if err != nil {
+		log.Panicln("can't make a session token:", err)
+	}
+	return token
+}
+
+// NewConnInfo starts a new session. Its pump runs until the session expires.
+func NewConnInfo() *ConnInfo {
+	conn := &ConnInfo{
+		Outbound: make(chan Envelope),
+		Token:    newSessionToken(),
+		attach:   make(chan *Socket),
+		expired:  make(chan bool),
+	}
+	go conn.pump(OUTBOUND_POLICY)
+	return conn
+}
+
+// pump copies everything sent to the session to whichever websocket is attached to it, and throws it away while none is. Messages wait
+// in an OutboundQueue until the websocket is ready for them, so sending to Outbound never blocks for long, whether or not the client is
+// connected or keeping up. Websockets that fall too far behind are hung up on, as the policy says.
+func (c *ConnInfo) pump(policy OutboundPolicy) {
+	var socket *Socket
+	var drained <-chan time.Time
+	expired := c.expired
+	queue := NewOutboundQueue(policy)
+	// This goes off when messages have been waiting for the websocket to take one for too long. Waiting is when they started.
+	stalled := time.NewTimer(policy.SlowClientTimeout)
+	stalled.Stop()
+	var waiting time.Time
+	hangUp := func() {
+		logWarn("hanging up on a client that fell behind with", queue.Len(), "messages waiting")
+		SLOW_CLIENTS.Inc()
+		close(socket.Slow)
+		socket = nil
+	}
+	for {
+		// Only offer the next message when there's somewhere to send it.
+		var send chan Envelope
+		var next Envelope
+		var done, replaced <-chan bool
+		if socket != nil {
+			done, replaced = socket.Done, socket.Replaced
+			if queue.Len() > 0 {
+				send, next = socket.Outbound, queue.Peek()
+			}
+		}
+		select {
+		case socket = <-c.attach:
+			// Anything still waiting goes to the new websocket.
+		case <-expired:
+			socket = nil
+			drained = time.After(SESSION_DRAIN_TIME)
+			expired = nil
+		case <-drained:
+			stalled.Stop()
+			return
+		case msg := <-c.Outbound:
+			if socket != nil && !queue.Push(msg) {
+				hangUp()
+			}
+		case send <- next:
+			queue.Pop()
+			// The client is keeping up, so it gets a fresh timeout for whatever is still waiting.
+			waiting = time.Time{}
+		case <-done:
+			socket = nil
+		case <-replaced:
+			socket = nil
+		case <-stalled.C:
+			if socket != nil && !waiting.IsZero() && time.Since(waiting) >= policy.SlowClientTimeout {
+				hangUp()
+			}
+			waiting = time.Time{}
+		}
+		if socket == nil {
+			queue.Clear()
+		}
+		if queue.Len() == 0 && !waiting.IsZero() {
+			stalled.Stop()
+			waiting = time.Time{}
+		} else if queue.Len() > 0 && waiting.IsZero() {
+			stalled.Reset(policy.SlowClientTimeout)
+			waiting = time.Now()
+		}
+	}
+}
+
+// attachSocket connects a new websocket to the session it asked to resume, or to a new session if it didn't ask for one, its
+// session has expired, or the session belongs to another account.
+func (l *lobby) attachSocket(socket *Socket, messages chan<- MessageInfo, leaving chan<- departure) {
+	conn, resumed := l.sessions[socket.Token]
+	if resumed && l.clients[conn].Name != socket.Name {
+		resumed = false
+	}
+	if !resumed {
+		conn = NewConnInfo()
+		user := &User{Name: socket.Name, BattleInputChan: make(chan BattleInput), BattleUpdateChan: make(chan Update), Challengers: make(map[*ConnInfo]bool)}
+		l.clients[conn] = user
+		l.sessions[conn.Token] = conn
+		l.joinRoom(conn, LOBBY_ROOM)
+	} else if conn.socket != nil {
+		// The old websocket might not have noticed that it's dead yet, or the user might have opened the game twice.
+		close(conn.socket.Replaced)
+	}
+	user := l.clients[conn]
+	conn.socket = socket
+	conn.disconnectedAt = time.Time{}
+	conn.attach <- socket
+
+	// Merge their Messages into the single messages channel.
+	go func() {
+		for m := range socket.Inbound {
+			// Associate the Request with the User so we can tell who sent it later.
+			messages <- MessageInfo{Request: m, User: user, Conn: conn}
+		}
+		// Let dispatch know that they're gone before we exit.
+		leaving <- departure{conn: conn, socket: socket}
+	}()
+
+	// The client keeps the token so it can resume the session if the websocket drops.
+	conn.Outbound <- NewEnvelope(TYPE_SESSION, Session{Token: conn.Token})
+	if !resumed {
+		return
+	}
+	logInfo(displayName(user.Name), "reconnected")
+	if user.InGame && user.Match.Over() {
+		// They won't get the last update, so they'd never say they're done with it.
+		user.InGame = false
+		conn.Outbound <- serverMessage("Your match ended while you were away.")
+	} else if user.InGame {
+		tellBattle(user, true)
+		conn.Outbound <- gameMessage(TYPE_RESUME_GAME, user.Match.Rules)
+		if user.Match.Training != nil {
+			conn.Outbound <- user.Match.Training.status()
+		}
+	}
+}
+
+// detachSocket handles a websocket disconnecting. The session is kept around in case the user comes back, but they can't be matched
+// or spectate in the meantime.
+func (l *lobby) detachSocket(gone departure) {
+	conn := gone.conn
+	// If another websocket has already taken over the session, there's nothing to do.
+	if conn.socket != gone.socket {
+		return
+	}
+	user := l.clients[conn]
+	logInfo(displayName(user.Name), "disconnected")
+	conn.socket = nil
+	conn.disconnectedAt = time.Now()
+	l.unready(conn)
+	stopSpectating(user)
+	if user.InGame && !user.Match.Over() {
+		tellBattle(user, false)
+	}
+}
+
+// expireSessions throws away the sessions of users who have been disconnected for longer than the grace period. Users in a match
+// are kept until the battle is over, since the battle decides when they forfeit.
+func (l *lobby) expireSessions(now time.Time) {
+	for conn, user := range l.clients {
+		if conn.socket != nil || now.Sub(conn.disconnectedAt) < RECONNECT_GRACE {
+			continue
+		}
+		if user.InGame && !user.Match.Over() {
+			continue
+		}
+		stopSpectating(user)
+		l.leaveRoom(conn)
+		// Nobody can accept their challenges anymore, and they can't accept anyone else's.
+		for _, other := range l.clients {
+			delete(other.Challengers, conn)
+		}
+		delete(l.clients, conn)
+		delete(l.sessions, conn.Token)
+		close(conn.expired)
+	}
+}
+
+// tellBattle lets the battle a user is in know whether they're connected.
+func tellBattle(user *User, connected bool) {
+	select {
+	case user.Match.Connections <- ConnectionChange{Player: user.Side, Connected: connected}:
+	case <-user.Match.Done:
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// When the server hangs up on a client, it first waits until nothing has been sent to them for this long.
+const HANG_UP_DELAY time.Duration = 100 * time.Millisecond
+
+// The lobby commands that start a match, which are turned down once the server is shutting down.
+var MATCH_COMMANDS = map[string]bool{
+	"READY":     true,
+	"CHALLENGE": true,
+	"ACCEPT":    true,
+	"PRACTICE":  true,
+	"TRAINING":  true,
+}
+
+// A Shutdown is how main tells everyone else the server is stopping. It happens in two steps. First the server drains: new websockets
+// are refused, no new matches can start, and the matches in progress are left to finish. If they haven't all finished by the time the
+// timeout runs out, the rest are stopped and called a draw. Either way, the dispatcher says when the last result has been saved. Then
+// every websocket is hung up on.
+type Shutdown struct {
+	// Closed when the server starts draining.
+	draining chan bool
+	// Closed when the timeout runs out.
+	stopping chan bool
+	// Closed by the dispatcher once it's draining and every match's result has been saved.
+	drained chan bool
+	// Closed to make every websocket hang up, and the websockets that are still open.
+	closing chan bool
+	sockets sync.WaitGroup
+}
+
+func NewShutdown() *Shutdown {
+	return &Shutdown{draining: make(chan bool), stopping: make(chan bool), drained: make(chan bool), closing: make(chan bool)}
+}
+
+// Draining reports whether the server has started shutting down.
+func (s *Shutdown) Draining() bool {
+	select {
+	case <-s.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// refuse turns away an HTTP request that would open a websocket if the server is shutting down, and reports whether it did.
+func (s *Shutdown) refuse(w http.ResponseWriter) bool {
+	if !s.Draining() {
+		return false
+	}
+	w.Header().Set("Retry-After", "60")
+	http.Error(w, "the server is shutting down", http.StatusServiceUnavailable)
+	return true
+}
+
+// Run drains the server and blocks until every match has finished or been stopped, and its result saved.
+func (s *Shutdown) Run(timeout time.Duration) {
+	close(s.draining)
+	select {
+	case <-s.drained:
+		return
+	case <-time.After(timeout):
+		logWarn("matches still in progress after", timeout, "are being stopped")
+	}
+	close(s.stopping)
+	<-s.drained
+}
+
+// CloseSockets hangs up on every websocket and waits until they've all closed, or until the context is done.
+func (s *Shutdown) CloseSockets(ctx context.Context) error {
+	close(s.closing)
+	closed := make(chan bool)
+	go func() {
+		s.sockets.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// hangUp tells a client the server is going away and closes its websocket.
+func hangUp(socket *websocket.Conn) {
+	socket.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "the server is shutting down"))
+	socket.Close()
+}
+
+// drain is called by the dispatcher when the server starts shutting down. It tells everyone and makes sure nobody is left waiting
+// for a match.
+func (l *lobby) drain() {
+	l.draining = true
+	for conn, user := range l.clients {
+		l.unready(conn)
+		for challenger := range user.Challengers {
+			delete(user.Challengers, challenger)
+		}
+		conn.Outbound <- serverMessage("The server is shutting down. Matches in progress can finish, but no new ones can start.")
+	}
+	// Training never ends on its own.
+	for match := range l.running {
+		if match.Training != nil {
+			match.stopBattle()
+		}
+	}
+	l.checkDrained()
+}
+
+// stopMatches ends every match that's still in progress in a draw.
+func (l *lobby) stopMatches() {
+	for match := range l.running {
+		match.stopBattle()
+		if match.Over() {
+			continue
+		}
+		for _, name := range match.Players {
+			if conn := l.findUser(name); conn != nil {
+				conn.Outbound <- serverMessage("The server is shutting down, so your match was called a draw.")
+			}
+		}
+	}
+}
+
+// checkDrained lets main know once the server is draining and no match results are left to save.
+func (l *lobby) checkDrained() {
+	if l.draining && len(l.running) == 0 && !l.shutdown.drainedClosed() {
+		close(l.shutdown.drained)
+	}
+}
+
+func (s *Shutdown) drainedClosed() bool {
+	select {
+	case <-s.drained:
+		return true
+	default:
+		return false
+	}
+}
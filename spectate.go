@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// How many updates can be waiting for a spectator before new ones are dropped. Spectators that fall behind miss updates instead of
+// slowing down the battle.
+const SPECTATOR_BUFFER int = 32
+
+// A SpectatorUpdate is what spectators get instead of an Update. Spectators aren't either player, so the players are just numbered.
+// The other fields mean the same as in an Update.
+type SpectatorUpdate struct {
+	Player1   PlayerStatus `json:"player1"`
+	Player2   PlayerStatus `json:"player2"`
+	Round     int          `json:"round"`
+	Wins      [2]int       `json:"wins"`
+	TimeLeft  int          `json:"timeLeft,omitempty"`
+	RoundOver bool         `json:"roundOver,omitempty"`
+	Over      bool         `json:"over,omitempty"`
+}
+
+// NewSpectatorUpdate makes a SpectatorUpdate out of the Updates for player 1 and player 2.
+func NewSpectatorUpdate(updates [2]Update) SpectatorUpdate {
+	return SpectatorUpdate{
+		Player1:   updates[0].Self,
+		Player2:   updates[1].Self,
+		Round:     updates[0].Round,
+		Wins:      [2]int{updates[0].Wins, updates[1].Wins},
+		TimeLeft:  updates[0].TimeLeft,
+		RoundOver: updates[0].RoundOver,
+		Over:      updates[0].Over,
+	}
+}
+
+// A Match is a battle in progress. The battle goroutine owns the list of spectators, so spectators join and leave by sending their
+// update channel through Join and Leave. Done is closed when the battle is over, after which nothing reads from Join or Leave, and
+// the result is sent through Results. Practice matches are against the computer and don't affect ratings, and training matches are
+// practice matches against a dummy, which aren't saved at all.
+// The dispatcher tells the battle through Connections when a player loses their connection or gets it back.
+type Match struct {
+	ID          int
+	Players     [2]string
+	Rules       *Rules
+	Practice    bool
+	Training    *Training
+	Started     time.Time
+	Join        chan chan SpectatorUpdate
+	Leave       chan chan SpectatorUpdate
+	Connections chan ConnectionChange
+	Done        chan bool
+	// Closed to make the battle stop where it is and end in a draw, when the server is shutting down or a player ends their training.
+	// Only the dispatcher closes it, through stopBattle.
+	Stop    chan bool
+	stopped bool
+	Results chan<- MatchResult
+}
+
+func NewMatch(id int, player1, player2 string, rules *Rules, results chan<- MatchResult) *Match {
+	return &Match{
+		ID:          id,
+		Players:     [2]string{player1, player2},
+		Rules:       rules,
+		Started:     time.Now(),
+		Join:        make(chan chan SpectatorUpdate),
+		Leave:       make(chan chan SpectatorUpdate),
+		Connections: make(chan ConnectionChange),
+		Done:        make(chan bool),
+		Stop:        make(chan bool),
+		Results:     results,
+	}
+}
+
+// Over reports whether the battle for this match has finished.
+func (m *Match) Over() bool {
+	select {
+	case <-m.Done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopBattle makes the battle stop where it is, if it hasn't been told to already.
+func (m *Match) stopBattle() {
+	if !m.stopped {
+		m.stopped = true
+		close(m.Stop)
+	}
+}
+
+func (m *Match) String() string {
+	return fmt.Sprintf("match %d: %s vs %s (%s rules)", m.ID, displayName(m.Players[0]), displayName(m.Players[1]), m.Rules.Name)
+}
+
+// displayName is used wherever a username is shown to other users. Everyone has to log in, so names shouldn't be blank, but a
+// blank one still shouldn't show up as nothing.
+func displayName(name string) string {
+	if name == "" {
+		return "anonymous"
+	}
+	return name
+}
+
+// broadcastSpectators sends an update to every spectator without blocking. It's called from the battle loop, so a slow spectator
+// just misses updates.
+func broadcastSpectators(spectators map[chan SpectatorUpdate]bool, update SpectatorUpdate) {
+	for spectator := range spectators {
+		select {
+		case spectator <- update:
+		default:
+		}
+	}
+}
+
+// forwardSpectatorUpdates copies a spectator's updates to their client until the battle closes the channel or they stop watching.
+func forwardSpectatorUpdates(dest chan Envelope, src chan SpectatorUpdate) {
+	for update := range src {
+		dest <- NewEnvelope(TYPE_SPECTATOR_UPDATE, update)
+	}
+}
+
+// listMatches describes every match that's still being fought, in the order they started.
+func listMatches(matches map[int]*Match) string {
+	ids := make([]int, 0, len(matches))
+	for id, match := range matches {
+		if match.Over() {
+			delete(matches, id)
+		} else {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return "There are no matches in progress."
+	}
+	sort.Ints(ids)
+	description := "Matches in progress:"
+	for _, id := range ids {
+		description += " [" + matches[id].String() + "]"
+	}
+	return description
+}
+
+// startSpectating subscribes a user to the match with the given ID. If that isn't possible, it returns a message for the user saying why.
+func startSpectating(user *User, conn *ConnInfo, matches map[int]*Match, matchID string) string {
+	if user.Spectating != nil && !user.Spectating.Over() {
+		return "You are already spectating " + user.Spectating.String() + "."
+	}
+	if user.Ready {
+		return "You can't spectate while you are ready for a game."
+	}
+	id, err := strconv.Atoi(matchID)
+	match, ok := matches[id]
+	if err != nil || !ok || match.Over() {
+		return "There is no match " + matchID + " in progress."
+	}
+	updates := make(chan SpectatorUpdate, SPECTATOR_BUFFER)
+	select {
+	case match.Join <- updates:
+	case <-match.Done:
+		return "That match just ended."
+	}
+	user.Spectating = match
+	user.SpectatorChan = updates
+	// Let the client know before any updates reach it. They wait in the buffer until then.
+	conn.Outbound <- NewEnvelope(TYPE_START_SPECTATING, SpectatingStart{Match: match.String()})
+	go forwardSpectatorUpdates(conn.Outbound, updates)
+	return ""
+}
+
+// stopSpectating unsubscribes a user from whatever match they're watching, if any.
+func stopSpectating(user *User) {
+	if user.Spectating == nil {
+		return
+	}
+	select {
+	case user.Spectating.Leave <- user.SpectatorChan:
+	case <-user.Spectating.Done:
+	}
+	user.Spectating = nil
+	user.SpectatorChan = nil
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"fmt"
+)
+
+// State is what a player is doing. On the wire it's sent as the state's name, like "light attack" or "interrupting heavy_up", which
+// is what app.js expects.
+type State int
+
+// NoState is the zero value. Players are never in it; it's only used for Player.Finished when nothing has just finished.
+const (
+	NoState State = iota
+	Standing
+	Blocking
+	LightAttack
+	HeavyAttack
+	Counterattack
+	Countered
+	// When a light attack lands before a heavy attack, the light attacker is interrupting and the heavy attacker is interrupted.
+	// Both are shown the same arrow, and whoever presses it first wins.
+	InterruptingUp
+	InterruptingDown
+	InterruptingLeft
+	InterruptingRight
+	InterruptedUp
+	InterruptedDown
+	InterruptedLeft
+	InterruptedRight
+	numStates
+)
+
+// The interrupt states for each arrow, in the order the arrow is picked at random.
+var INTERRUPTING_STATES = [4]State{InterruptingUp, InterruptingDown, InterruptingLeft, InterruptingRight}
+var INTERRUPTED_STATES = [4]State{InterruptedUp, InterruptedDown, InterruptedLeft, InterruptedRight}
+
+// StateInfo describes a State for the transition table.
+// Duration is how many cycles the state lasts; nil means it has no duration of its own.
+// Interruptable states are the ones a player can start a block, attack or dodge from.
+// Terminal states don't end when their duration runs out. The player stays in them until something happens to take them out.
+// Attack states can be dodged.
+// OnFinish is what happens when the state's duration runs out, like an attack landing.
+// Next lists the states that can be entered from this one. Anything else is an illegal transition.
+// Arrow is only set for the interrupt states. It's the arrow the player has to press, and Interrupting tells which side they're on.
+type StateInfo struct {
+	Name          string
+	Duration      func(rules *Rules) int
+	Interruptable bool
+	Terminal      bool
+	Attack        bool
+	OnFinish      func(player *Player, enemy *Player, rules *Rules) error
+	Next          []State
+	Arrow         string
+	Interrupting  bool
+}
+
+// STATES is the transition table. It's filled in by init() because the OnFinish functions change states themselves, and Go doesn't
+// allow a variable's initializer to refer back to the variable.
+var STATES [numStates]StateInfo
+
+// These are derived from STATES by init().
+var INTERRUPTABLE_STATES map[State]bool
+var TERMINAL_STATES map[State]bool
+var ATTACK_STATES map[State]bool
+
+func init() {
+	// Any action can be started from an interruptable state.
+	fromInterruptable := []State{Standing, Blocking, LightAttack, HeavyAttack, InterruptingUp, InterruptingDown, InterruptingLeft, InterruptingRight}
+	STATES = [numStates]StateInfo{
+		NoState: {Name: ""},
+		Standing: {
+			Name: "standing", Interruptable: true, Terminal: true,
+			// A player who just finished a light attack is standing when they get countered.
+			Next: append([]State{Countered}, fromInterruptable...),
+		},
+		Blocking: {
+			Name: "blocking", Interruptable: true, Terminal: true,
+			Next: append([]State{Counterattack}, fromInterruptable...),
+		},
+		LightAttack: {
+			Name: "light attack", Attack: true,
+			Duration: func(rules *Rules) int { return rules.LightAttackSpeed },
+			OnFinish: finishLightAttack,
+			Next:     []State{Standing},
+		},
+		HeavyAttack: {
+			Name: "heavy attack", Attack: true,
+			Duration: func(rules *Rules) int { return rules.HeavyAttackSpeed },
+			OnFinish: finishHeavyAttack,
+			Next:     []State{Standing, InterruptedUp, InterruptedDown, InterruptedLeft, InterruptedRight},
+		},
+		Counterattack: {
+			Name:     "counterattack",
+			Duration: func(rules *Rules) int { return rules.CounterattackSpeed },
+			OnFinish: finishCounterattack,
+			Next:     []State{Standing},
+		},
+		// Countered players are only stunned for the cycle they get countered on, and go back to standing on the next one. Its
+		// duration has already run out as soon as it starts.
+		Countered: {
+			Name:     "countered",
+			Duration: func(rules *Rules) int { return -1 },
+			Next:     []State{Standing},
+		},
+	}
+	for i, arrow := range []string{"up", "down", "left", "right"} {
+		STATES[INTERRUPTING_STATES[i]] = StateInfo{Name: "interrupting heavy_" + arrow, Terminal: true, Next: []State{Standing}, Arrow: arrow, Interrupting: true}
+		STATES[INTERRUPTED_STATES[i]] = StateInfo{Name: "interrupted heavy_" + arrow, Terminal: true, Next: []State{Standing}, Arrow: arrow}
+	}
+
+	INTERRUPTABLE_STATES = statesWhere(func(info StateInfo) bool { return info.Interruptable })
+	TERMINAL_STATES = statesWhere(func(info StateInfo) bool { return info.Terminal })
+	ATTACK_STATES = statesWhere(func(info StateInfo) bool { return info.Attack })
+}
+
+// statesWhere returns the set of states that match a condition.
+func statesWhere(condition func(info StateInfo) bool) map[State]bool {
+	states := make(map[State]bool)
+	for state := Standing; state < numStates; state++ {
+		if condition(STATES[state]) {
+			states[state] = true
+		}
+	}
+	return states
+}
+
+func (s State) String() string {
+	if s < 0 || s >= numStates {
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+	return STATES[s].Name
+}
+
+// CanBecome reports whether the transition table allows going from s to next.
+func (s State) CanBecome(next State) bool {
+	if s < 0 || s >= numStates {
+		return false
+	}
+	for _, allowed := range STATES[s].Next {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	if s <= NoState || s >= numStates {
+		return nil, fmt.Errorf("can't encode invalid state %d", int(s))
+	}
+	return []byte(STATES[s].Name), nil
+}
+
+func (s *State) UnmarshalText(text []byte) error {
+	for state := Standing; state < numStates; state++ {
+		if STATES[state].Name == string(text) {
+			*s = state
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown state %q", string(text))
+}
+
+// firstError returns the first of its arguments that isn't nil. It lets several state changes happen together and still report
+// whether any of them were illegal.
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
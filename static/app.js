@@ -0,0 +1,516 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+var newMsg = ''; // Holds new messages to be sent to the server
+var chatContent = ''; // A running list of chat messages displayed on the screen
+var username = null; // Our username. The server only lets us use the account we logged in to.
+// If the page was opened with ?replay=<id>, we watch that replay instead of joining the lobby.
+var replayID = new URLSearchParams(window.location.search).get('replay');
+// The server gives us a session token so that we can pick up where we left off if the connection drops.
+var sessionToken = sessionStorage.getItem('session');
+var socket;
+// This variable is set later, in the battle() function. It has to be initialized here so that other functions can have access to it.
+var inputter = null;
+// True while we're watching someone else's match instead of fighting.
+var spectating = false;
+// The rules of the match we're in. The server sends them when the match starts so that we can predict what our inputs will do.
+var rules = null;
+// Recent updates from the server by tick, the inputs we've sent that the server hasn't acknowledged yet, and the newest tick we've seen.
+// Inputs are tagged with that tick so the server can apply them to the cycle we meant them for, even if they arrive late.
+var updateHistory = {};
+var sentInputs = [];
+var latestTick = 0;
+// How many ticks of updates to keep. Anything older than this is too old for the server to roll back to anyway.
+var HISTORY_LENGTH = 100;
+// The version of the protocol this client speaks. See protocol.go.
+var PROTOCOL_VERSION = 2;
+// Set if the server told us it doesn't speak our version, in which case reconnecting won't help.
+var outdated = false;
+// True while we're training against a dummy.
+var training = false;
+
+function connect () {
+  // Pages served over HTTPS have to use a secure websocket too.
+  var base = (window.location.protocol == 'https:' ? 'wss://' : 'ws://') + window.location.host;
+  var url = base + '/ws?version=' + PROTOCOL_VERSION;
+  if (replayID) {
+    url = base + '/replay?version=' + PROTOCOL_VERSION + '&id=' + encodeURIComponent(replayID);
+  } else if (sessionToken) {
+    url += '&session=' + encodeURIComponent(sessionToken);
+  }
+  socket = new WebSocket(url);
+  socket.onmessage = function(e) {
+    var envelope = JSON.parse(e.data);
+    console.log(envelope)
+    handleMessage(envelope.type, envelope.data)
+  };
+  // Replays just end, but otherwise try to get back to our session.
+  if (!replayID) {
+    socket.onclose = function() {
+      if (outdated) {
+        return;
+      }
+      Materialize.toast('Lost connection to the server, reconnecting...', 2000);
+      setTimeout(connect, 1000);
+    };
+  }
+}
+
+// sendMessage wraps a message in an envelope and sends it to the server.
+function sendMessage (type, data) {
+  socket.send(JSON.stringify({version: PROTOCOL_VERSION, type: type, data: data}));
+}
+
+// Replays can be watched by anyone, but the lobby needs us to log in first. We might still be logged in from last time.
+if (replayID) {
+  connect();
+} else {
+  fetch('/api/me', {credentials: 'same-origin'}).then(function(response) {
+    if (response.ok) {
+      response.json().then(joined);
+    }
+  });
+}
+
+function handleMessage(type, data) {
+  switch (type) {
+    case "welcome":
+      return;
+    case "session":
+      sessionToken = data.token;
+      sessionStorage.setItem('session', sessionToken);
+      return;
+    case "start_game":
+      startPredicting(data.rules);
+      battle();
+      return;
+    // We reconnected in the middle of a match. If the page was reloaded, the battle screen has to be brought back.
+    case "resume_game":
+      if (inputter == null) {
+        startPredicting(data.rules);
+        battle();
+      }
+      return;
+    case "start_spectating":
+      spectating = true;
+      battle();
+      return;
+    case "training":
+      showTraining(data);
+      return;
+    case "update":
+      if (spectating || replayID || !data.tick) {
+        handleBattleUpdate(data)
+        return;
+      }
+      updateHistory[data.tick] = data;
+      delete updateHistory[data.tick - HISTORY_LENGTH];
+      latestTick = data.tick;
+      sentInputs = sentInputs.filter(function(input) { return input.tick > data.ack; });
+      handleBattleUpdate(predict(data, updateHistory, sentInputs, rules))
+      return;
+    // Spectators see player 1 on the left and player 2 on the right.
+    case "spectator_update":
+      handleBattleUpdate({self: data.player1, enemy: data.player2, round: data.round, wins: data.wins[0], enemyWins: data.wins[1],
+        timeLeft: data.timeLeft, roundOver: data.roundOver, over: data.over})
+      return;
+    case "error":
+      if (data.code == "unsupported_version") {
+        outdated = true;
+      }
+      Materialize.toast(data.message, 4000);
+      return;
+    case "chat":
+      handleChatMessage(data)
+      return;
+    default:
+      console.log("got a message of unknown type " + type)
+  }
+}
+
+function handleChatMessage(chat) {
+  chatContent += '<div class="chip">'
+   + chat.from
+   + '</div>'
+   + (chat.text) + '<br/>';
+  var element = document.getElementById('chat-messages');
+  element.innerHTML=chatContent;
+  element.scrollTop = element.scrollHeight; // Auto scroll to the bottom
+};
+
+function send () {
+    newMsg=document.getElementById("msgbox").value;
+    console.log("newmsg is"+newMsg);
+    // Messages starting with a slash are lobby commands, like "/spectate 3".
+    if (newMsg.charAt(0) == '/') {
+        sendCommand(newMsg);
+        document.getElementById("msgbox").value="";
+        return;
+    }
+    if (newMsg != '') {
+        sendMessage("chat", {text: newMsg});
+        document.getElementById("msgbox").value=""; // Reset the message box
+    }
+}
+
+function sendCommand (text) {
+    var words = text.slice(1).split(' ');
+    var arg = words.slice(1).join(' ');
+    var command;
+    switch (words[0]) {
+      case "matches":
+        command = "LIST MATCHES";
+        break;
+      case "spectate":
+        command = "SPECTATE";
+        break;
+      case "ratings":
+        command = "RATINGS";
+        break;
+      case "rules":
+        command = "LIST RULES";
+        break;
+      case "setrules":
+        command = "SET RULES";
+        break;
+      case "rooms":
+        command = "LIST ROOMS";
+        break;
+      case "create":
+        command = "CREATE ROOM";
+        break;
+      case "join":
+        command = "JOIN ROOM";
+        break;
+      case "leave":
+        command = "LEAVE ROOM";
+        break;
+      case "invite":
+        command = "INVITE";
+        break;
+      case "challenge":
+        command = "CHALLENGE";
+        break;
+      case "accept":
+        command = "ACCEPT";
+        break;
+      case "decline":
+        command = "DECLINE";
+        break;
+      case "practice":
+        command = "PRACTICE";
+        break;
+      case "training":
+        command = "TRAINING";
+        break;
+      case "dummy":
+        command = "DUMMY";
+        break;
+      case "reset":
+        command = "RESET";
+        break;
+      case "record":
+        command = "RECORD";
+        break;
+      case "playback":
+        command = "PLAYBACK";
+        break;
+      case "jitter":
+        command = "JITTER";
+        break;
+      case "recordings":
+        command = "RECORDINGS";
+        break;
+      default:
+        Materialize.toast('Unknown command: /' + words[0], 2000);
+        return;
+    }
+    // Changing rooms or practicing takes us out of the ready queue.
+    if (command == "CREATE ROOM" || command == "JOIN ROOM" || command == "LEAVE ROOM" || command == "PRACTICE" || command == "TRAINING") {
+        document.getElementById("readybutton").innerHTML="Ready for game";
+    }
+    sendMessage("command", {command: command, argument: arg});
+}
+
+// login and register send the username and password from the form to the server, which sets a cookie if they're accepted.
+function login () {
+    sendCredentials('/api/login');
+}
+
+function register () {
+    sendCredentials('/api/register');
+}
+
+function sendCredentials (url) {
+    var credentials = {
+        username: document.getElementById("usernamebox").value,
+        password: document.getElementById("passwordbox").value
+    };
+    if (!credentials.username || !credentials.password) {
+        Materialize.toast('You must enter a username and password', 2000);
+        return;
+    }
+    fetch(url, {
+        method: 'POST',
+        credentials: 'same-origin',
+        body: JSON.stringify(credentials)
+    }).then(function(response) {
+        if (response.ok) {
+            response.json().then(joined);
+        } else {
+            response.text().then(function(text) {
+                Materialize.toast(text, 2000);
+            });
+        }
+    });
+}
+
+// joined is called once we're logged in. It connects to the lobby.
+function joined (account) {
+    username = account.username;
+    console.log("username is "+username);
+    document.getElementById("passwordbox").value = "";
+    document.getElementById("afterjoin").style.display = "block";
+    document.getElementById("beforejoin").style.display = "none";
+    connect();
+}
+
+function toggleReady () {
+    console.log("(Un)readying for game...");
+    readyStatus = document.getElementById("readybutton").innerHTML;
+    if (readyStatus.search("Unready for game")==-1) {
+        var command = "READY";
+        document.getElementById("readybutton").innerHTML="Unready for game";
+    } else {
+        var command = "UNREADY";
+        document.getElementById("readybutton").innerHTML="Ready for game";
+    }
+    sendMessage("command", {command: command});
+}
+
+function enter (event) {
+    if (event.keyCode == 13) {
+        send()
+    }
+}
+
+
+// startPredicting forgets about the last match and takes the rules for the next one.
+function startPredicting(matchRules) {
+  rules = matchRules || null;
+  updateHistory = {};
+  sentInputs = [];
+  latestTick = 0;
+}
+
+function handleBattleUpdate(update) {
+  if (update.over) {
+    document.getElementById('battleUI').style.display="none"
+    document.getElementById('chat').style.display="block"
+    // Display a message telling the result of the battle.
+    var result = "Result of battle: you won "+update.wins+" of "+update.round+" rounds and the enemy won "+update.enemyWins
+     +". In the last round, you had "+update.self.life.toString()+" life and the enemy had "+update.enemy.life.toString()
+    if (training) {
+      result = "Training is over."
+    } else if (spectating) {
+      result = "Result of battle: player 1 won "+update.wins+" of "+update.round+" rounds and player 2 won "+update.enemyWins
+       +". In the last round, player 1 had "+update.self.life.toString()+" life and player 2 had "+update.enemy.life.toString()
+    } else if (update.enemyForfeited) {
+      result = "You win! Your opponent didn't reconnect in time."
+    }
+    chatContent += '<div class="chip">'
+     + "server"
+     + "</div>"
+     + result + "<br>";
+    var element = document.getElementById('chat-messages');
+    element.innerHTML=chatContent;
+    element.scrollTop = element.scrollHeight;
+
+    clearInterval(inputter)
+    inputter = null
+    // Replays don't care, since they're over either way.
+    if (!replayID) {
+      sendMessage("command", {command: spectating ? "STOP SPECTATING" : "END MATCH"});
+    }
+    spectating = false
+    training = false
+    document.getElementById('trainingControls').style.display="none"
+  }
+  document.getElementById('ownLife').style.width=update.self.life.toString()+"%"
+  document.getElementById('ownStam').style.width=update.self.stamina.toString()+"%"
+  document.getElementById('ownDuration').style.width=update.self.stateDur.toString()+"%"
+  document.getElementById('enemyLife').style.width=update.enemy.life.toString()+"%"
+  document.getElementById('enemyStam').style.width=update.enemy.stamina.toString()+"%"
+  document.getElementById('enemyDuration').style.width=update.enemy.stateDur.toString()+"%"
+  document.getElementById('enemyDisconnected').style.display=update.enemyDisconnected ? "block" : "none"
+  // The time left is in cycles, which are 10ms each.
+  var roundInfo = "Round "+update.round+" - "+update.wins+" to "+update.enemyWins
+  if (update.roundOver) {
+    roundInfo += " - round over"
+  } else if (update.timeLeft) {
+    roundInfo += " - "+Math.ceil(update.timeLeft/100)+"s left"
+  }
+  document.getElementById('roundInfo').innerHTML=roundInfo
+  var ownState=update.self.state
+  var enemyState=update.enemy.state
+  document.getElementById('ownBlockSymbol').style.display="none"
+  document.getElementById('ownLightSymbol').style.display="none"
+  document.getElementById('ownLeftLightSymbol').style.display="none"
+  document.getElementById('ownHeavySymbol').style.display="none"
+  document.getElementById('enemyBlockSymbol').style.display="none"
+  document.getElementById('enemyLightSymbol').style.display="none"
+  document.getElementById('enemyHeavySymbol').style.display="none"
+  document.getElementById('enemyRightLightSymbol').style.display="none"
+  document.getElementById('leftArrowSymbol').style.display="none"
+  document.getElementById('upArrowSymbol').style.display="none"
+  document.getElementById('rightArrowSymbol').style.display="none"
+  document.getElementById('downArrowSymbol').style.display="none"
+  switch (ownState) {
+    case "standing":
+      break
+    case "blocking":
+      document.getElementById('ownBlockSymbol').style.display="inline-block"
+      break;
+    case "light attack":
+      document.getElementById('ownLightSymbol').style.display="inline-block"
+      break;
+    case "heavy attack":
+      document.getElementById('ownHeavySymbol').style.display="inline-block"
+      break;
+    case "counterattack":
+      document.getElementById('ownBlockSymbol').style.display="inline-block"
+      document.getElementById('ownLightSymbol').style.display="inline-block"
+      break;
+    case "countered":
+      document.getElementById('ownLeftLightSymbol').style.display="inline-block"
+      document.getElementById('ownBlockSymbol').style.display="inline-block"
+      break;
+    default:
+//      if (ownState.search("interrupt")==0) {
+      arrow=ownState.slice(ownState.indexOf("_")+1,ownState.length)
+      document.getElementById('ownHeavySymbol').style.display="inline-block"
+      document.getElementById(arrow+'ArrowSymbol').style.display="inline-block"
+  }
+  switch (enemyState) {
+    case "standing":
+      break
+    case "blocking":
+      document.getElementById('enemyBlockSymbol').style.display="inline-block"
+      break;
+    case "light attack":
+      document.getElementById('enemyLightSymbol').style.display="inline-block"
+      break;
+    case "heavy attack":
+      document.getElementById('enemyHeavySymbol').style.display="inline-block"
+      break;
+    case "counterattack":
+      document.getElementById('enemyBlockSymbol').style.display="inline-block"
+      document.getElementById('enemyLightSymbol').style.display="inline-block"
+      break;
+    case "countered":
+      document.getElementById('enemyRightLightSymbol').style.display="inline-block"
+      document.getElementById('enemyBlockSymbol').style.display="inline-block"
+      break;
+    default:
+      document.getElementById('enemyLightSymbol').style.display="inline-block"
+  }
+};
+
+
+// showTraining brings up the training controls, set to what the server says the dummy and settings are.
+function showTraining (status) {
+  training = true;
+  var select = document.getElementById('dummySelect');
+  select.innerHTML = '';
+  status.dummies.forEach(function(name) {
+    var option = document.createElement('option');
+    option.value = option.text = name;
+    option.selected = name == status.dummy;
+    select.appendChild(option);
+  });
+  // A recording isn't one of the dummies, but it's shown with them so that the player can switch back.
+  var recording = document.getElementById('trainingRecording');
+  if (status.recording) {
+    var option = document.createElement('option');
+    option.text = "recording " + status.recording;
+    option.selected = true;
+    option.disabled = true;
+    select.appendChild(option);
+    recording.textContent = "Playing " + status.recording + ": " + status.sequence + (status.jitter ? " (jitter " + status.jitter + " ticks)" : "");
+  } else {
+    recording.textContent = "";
+  }
+  document.getElementById('infiniteLife').checked = status.infiniteLife;
+  document.getElementById('infiniteStamina').checked = status.infiniteStamina;
+  document.getElementById('trainingControls').style.display="block"
+}
+
+// sendTrainingCommand sends a command from one of the training controls. The control gives up the focus afterwards, so that the
+// keys for the fight don't go to it instead.
+function sendTrainingCommand (control, command, arg) {
+  sendMessage("command", {command: command, argument: arg || ""});
+  control.blur();
+}
+
+function battle () {
+  document.getElementById("readybutton").innerHTML="Ready for game";
+  document.getElementById('chat').style.display="none"
+  document.getElementById('battleUI').style.display="block"
+  // Replays and other people's matches only need to be watched, so there's no input to send.
+  if (replayID || spectating) {
+    return
+  }
+  // should probably play a sound to notify the user when they get matched
+  var input = "NONE"
+  document.addEventListener('keyup', function(e) {
+    if (e.keyCode == 32) {
+      input = "NONE"
+      }
+    return
+  });
+  document.addEventListener('keydown', function(e) {
+    switch (e.keyCode) {
+      case 32:
+        input = "BLOCK"
+        return
+      case 81:
+        input = "LIGHT"
+        return
+      case 87:
+        input = "HEAVY"
+        return
+      case 37:
+        input = "INTERRUPT_LEFT"
+        return
+      case 38:
+        input = "INTERRUPT_UP"
+        return
+      case 39:
+        input = "INTERRUPT_RIGHT"
+        return
+      case 40:
+        input = "INTERRUPT_DOWN"
+        return
+    }
+    if (e.shiftKey) {
+      input = "DODGE"
+      return
+    }
+    if (e.ctrlKey) {
+      input = "SAVE"
+      return
+    }
+  });
+
+  function sendUpdate () {
+    console.log("sending input to server")
+    sendMessage("input", {input: input, tick: latestTick})
+    sentInputs.push({tick: latestTick, command: input})
+    if (input!="BLOCK"){
+      input = "NONE"
+    }
+  }
+  inputter = setInterval(sendUpdate,20)
+}
\ No newline at end of file
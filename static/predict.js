@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This is a copy of the battle rules in battle.go and state.go. The client uses it to show the results of the player's own inputs
+// right away instead of waiting for the server to confirm them. The server always has the final say: once it has an input, its
+// updates already include the input, and the prediction for it is thrown away. It can't be exact, since the client doesn't know what
+// the enemy is about to press, which player the server handles first, or which arrow an interrupt will pick, so prediction just stops
+// when an interrupt would start.
+
+var PREDICT_DURATIONS = {
+  "light attack": function(rules) { return rules.lightAttackSpeed; },
+  "heavy attack": function(rules) { return rules.heavyAttackSpeed; },
+  "counterattack": function(rules) { return rules.counterattackSpeed; },
+  "countered": function(rules) { return -1; }
+};
+
+function isTerminal (state) {
+  return state == "standing" || state == "blocking" || state.search("interrupt") == 0;
+}
+
+function isInterruptable (state) {
+  return state == "standing" || state == "blocking";
+}
+
+function isAttack (state) {
+  return state == "light attack" || state == "heavy attack";
+}
+
+function setState (player, state, rules) {
+  player.state = state;
+  player.stateDur = PREDICT_DURATIONS.hasOwnProperty(state) ? PREDICT_DURATIONS[state](rules) : 0;
+}
+
+function passTime (player, rules) {
+  player.stamina = Math.min(player.stamina + rules.staminaRegen, rules.maxStamina);
+  player.stateDur -= 1;
+  if (player.stateDur <= 0 && !isTerminal(player.state)) {
+    player.finished = player.state;
+    setState(player, "standing", rules);
+  }
+}
+
+function resolveState (player, enemy, rules) {
+  var finished = player.finished;
+  player.finished = "";
+  switch (finished) {
+    case "light attack":
+      if (enemy.state == "blocking" && enemy.stamina >= rules.lightAttackBlockCost) {
+        enemy.stamina -= rules.lightAttackBlockCost;
+        if (-enemy.stateDur < rules.lightAttackSpeed) {
+          setState(player, "countered", rules);
+          setState(enemy, "counterattack", rules);
+        }
+      } else {
+        if (enemy.state == "blocking") {
+          enemy.stamina = 0;
+        }
+        enemy.life -= rules.lightAttackDamage;
+      }
+      break;
+    case "counterattack":
+      enemy.life -= rules.counterattackDamage;
+      setState(enemy, "standing", rules);
+      break;
+    case "heavy attack":
+      if (enemy.state == "blocking" && enemy.stamina >= rules.heavyAttackBlockCost) {
+        enemy.stamina -= rules.heavyAttackBlockCost;
+        enemy.life -= rules.heavyAttackBlockedDamage;
+      } else if (enemy.state == "blocking") {
+        enemy.stamina = 0;
+        enemy.life -= rules.heavyAttackDamage;
+      } else {
+        enemy.life -= rules.heavyAttackDamage;
+        setState(enemy, "standing", rules);
+      }
+      break;
+  }
+}
+
+// resolveCommand returns false if the command starts an interrupt, which can't be predicted.
+function resolveCommand (player, enemy, rules) {
+  switch (player.command) {
+    case "NONE":
+      if (player.state == "blocking") {
+        setState(player, "standing", rules);
+      }
+      break;
+    case "BLOCK":
+      if (isInterruptable(player.state) && player.state != "blocking") {
+        setState(player, "blocking", rules);
+      }
+      break;
+    case "DODGE":
+      if (isInterruptable(player.state) && player.stamina >= rules.dodgeCost && enemy.stateDur > rules.dodgeWindow) {
+        player.stamina -= rules.dodgeCost;
+        if (isAttack(enemy.state)) {
+          setState(enemy, "standing", rules);
+        }
+      }
+      break;
+    case "SAVE":
+      if (player.state == "countered") {
+        setState(player, "standing", rules);
+        setState(enemy, "standing", rules);
+      }
+      break;
+    case "LIGHT":
+      if (isInterruptable(player.state) && player.stamina >= rules.lightAttackCost) {
+        if (enemy.state == "heavy attack" && enemy.stateDur > rules.lightAttackSpeed) {
+          return false;
+        }
+        player.stamina -= rules.lightAttackCost;
+        setState(player, "light attack", rules);
+      }
+      break;
+    case "HEAVY":
+      if (isInterruptable(player.state) && player.stamina >= rules.heavyAttackCost) {
+        setState(player, "heavy attack", rules);
+        player.stamina -= rules.heavyAttackCost;
+      }
+      break;
+    default:
+      if (player.command.search("INTERRUPT_") == 0 && player.state.search("interrupt") == 0) {
+        var arrow = player.state.slice(player.state.indexOf("_")+1);
+        var interrupting = player.state.search("interrupting") == 0;
+        if (player.command.slice(10).toLowerCase() == arrow) {
+          if (!interrupting) {
+            enemy.life -= rules.heavyAttackDamage;
+          }
+        } else if (interrupting) {
+          // The server has the heavy attacker take the damage here too, so the prediction does the same.
+          enemy.life -= rules.heavyAttackDamage;
+        }
+        setState(player, "standing", rules);
+        setState(enemy, "standing", rules);
+      }
+  }
+  if (player.command != "BLOCK") {
+    player.command = "NONE";
+  }
+  return true;
+}
+
+// predictStep advances the players by one cycle, like Simulation.Step. It returns false if the result can't be predicted.
+function predictStep (players, commands, rules) {
+  for (var p = 0; p < 2; p++) {
+    if (commands[p]) {
+      players[p].command = commands[p];
+    }
+  }
+  for (var p = 0; p < 2; p++) {
+    var player = players[p];
+    var enemy = players[1-p];
+    passTime(player, rules);
+    if (player.finished) {
+      resolveState(player, enemy, rules);
+    }
+    if (!resolveCommand(player, enemy, rules)) {
+      return false;
+    }
+  }
+  return true;
+}
+
+// predict takes the newest update from the server and returns what it will probably look like once the server has the inputs we've
+// sent since. history holds recent updates by tick, and inputs holds the inputs the server hasn't acknowledged, oldest first, each
+// with the tick it was tagged with. The enemy is shown as the server last saw them, since there's no telling what they'll press.
+function predict (update, history, inputs, rules) {
+  if (!rules || update.roundOver || inputs.length == 0 || !history.hasOwnProperty(inputs[0].tick)) {
+    return update;
+  }
+  var start = history[inputs[0].tick];
+  // Inputs are ignored between rounds, and a new round starts everyone over.
+  if (start.roundOver || start.round != update.round) {
+    return update;
+  }
+  var players = [start.self, start.enemy].map(function(status) {
+    return {
+      life: status.life,
+      stamina: status.stamina,
+      state: status.state,
+      stateDur: status.stateDur,
+      // Someone who's blocking is holding the block key.
+      command: status.state == "blocking" ? "BLOCK" : "NONE",
+      finished: ""
+    };
+  });
+  var next = 0;
+  // This goes one cycle past the update, which is where an input pressed just now will land.
+  for (var tick = start.tick; tick <= update.tick; tick++) {
+    var command = "";
+    // Like on the server, a "NONE" doesn't replace another command for the same cycle.
+    while (next < inputs.length && inputs[next].tick <= tick) {
+      if (inputs[next].command != "NONE" || command == "") {
+        command = inputs[next].command;
+      }
+      next++;
+    }
+    if (!predictStep(players, [command, ""], rules)) {
+      return update;
+    }
+  }
+  var self = players[0];
+  var predicted = Object.assign({}, update);
+  predicted.self = {life: self.life, stamina: self.stamina, state: self.state, stateDur: self.stateDur};
+  return predicted;
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Finished matches are appended to this file, one JSON object per line.
+var MATCH_STORE_PATH string = "matches.jsonl"
+
+// A MatchRecord is everything kept about a finished match. Winner is empty for a draw. Forfeit is set if the loser lost by not
+// reconnecting in time, and Stopped if the server stopped it before it finished because it was shutting down. Practice is set for
+// matches against the computer. Rounds is how many rounds each player won, and Timing is how well the server kept up with the match.
+type MatchRecord struct {
+	Date     time.Time      `json:"date"`
+	Players  [2]string      `json:"players"`
+	Winner   string         `json:"winner"`
+	Forfeit  bool           `json:"forfeit,omitempty"`
+	Stopped  bool           `json:"stopped,omitempty"`
+	Practice bool           `json:"practice,omitempty"`
+	Rules    string         `json:"rules"`
+	Rounds   [2]int         `json:"rounds"`
+	Ticks    int            `json:"ticks"`
+	Stats    [2]BattleStats `json:"stats"`
+	ReplayID string         `json:"replay"`
+	Timing   TickStats      `json:"timing"`
+}
+
+// NewMatchRecord summarizes a MatchResult for storage.
+func NewMatchRecord(result MatchResult) MatchRecord {
+	record := MatchRecord{
+		Date:     time.Now(),
+		Players:  result.Match.Players,
+		Forfeit:  result.Forfeit(),
+		Stopped:  result.Stopped,
+		Practice: result.Match.Practice,
+		Rules:    result.Match.Rules.Name,
+		Rounds:   [2]int{result.Final[0].Wins, result.Final[1].Wins},
+		Ticks:    result.Ticks,
+		Stats:    result.Stats,
+		ReplayID: result.ReplayID,
+		Timing:   result.Timing,
+	}
+	if winner := result.Winner(); winner >= 0 {
+		record.Winner = result.Match.Players[winner]
+	}
+	return record
+}
+
+// PlayerStats are a player's totals over every match they've played.
+type PlayerStats struct {
+	Player        string `json:"player"`
+	Matches       int    `json:"matches"`
+	Wins          int    `json:"wins"`
+	Losses        int    `json:"losses"`
+	Draws         int    `json:"draws"`
+	Forfeits      int    `json:"forfeits"`
+	Ticks         int    `json:"ticks"`
+	DamageDealt   int    `json:"damageDealt"`
+	DamageTaken   int    `json:"damageTaken"`
+	Counters      int    `json:"counters"`
+	InterruptsWon int    `json:"interruptsWon"`
+	Blocks        int    `json:"blocks"`
+	Dodges        int    `json:"dodges"`
+}
+
+// add counts one match toward the player's totals.
+func (s *PlayerStats) add(record MatchRecord) {
+	for i, name := range record.Players {
+		if name != s.Player {
+			continue
+		}
+		own, enemy := record.Stats[i], record.Stats[1-i]
+		s.Matches++
+		switch record.Winner {
+		case "":
+			s.Draws++
+		case name:
+			s.Wins++
+		default:
+			s.Losses++
+			if record.Forfeit {
+				s.Forfeits++
+			}
+		}
+		s.Ticks += record.Ticks
+		s.DamageDealt += own.DamageDealt
+		s.DamageTaken += enemy.DamageDealt
+		s.Counters += own.Counters
+		s.InterruptsWon += own.InterruptsWon
+		s.Blocks += own.Blocks
+		s.Dodges += own.Dodges
+		return
+	}
+}
+
+// A Store keeps the history of finished matches. It must be safe to use from multiple goroutines, since the dispatcher writes to it
+// while HTTP handlers read from it.
+type Store interface {
+	SaveMatch(record MatchRecord) error
+	// History returns every match the player was in, newest first.
+	History(player string) ([]MatchRecord, error)
+	Stats(player string) (PlayerStats, error)
+	// Matches returns every match, oldest first.
+	Matches() ([]MatchRecord, error)
+}
+
+// MemoryStore is a Store that forgets everything when the server stops. It's useful for tests.
+type MemoryStore struct {
+	mutex   sync.RWMutex
+	records []MatchRecord
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make([]MatchRecord, 0)}
+}
+
+func (s *MemoryStore) SaveMatch(record MatchRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *MemoryStore) History(player string) ([]MatchRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	history := make([]MatchRecord, 0)
+	for i := len(s.records) - 1; i >= 0; i-- {
+		if s.records[i].Players[0] == player || s.records[i].Players[1] == player {
+			history = append(history, s.records[i])
+		}
+	}
+	return history, nil
+}
+
+func (s *MemoryStore) Matches() ([]MatchRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]MatchRecord(nil), s.records...), nil
+}
+
+func (s *MemoryStore) Stats(player string) (PlayerStats, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	stats := PlayerStats{Player: player}
+	for _, record := range s.records {
+		stats.add(record)
+	}
+	return stats, nil
+}
+
+// FileStore is a Store that appends every match to a file and keeps a copy of everything in memory for reading. The file is read
+// back in when the server starts.
+type FileStore struct {
+	MemoryStore
+	file *os.File
+}
+
+func OpenFileStore(path string) (*FileStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	store := &FileStore{MemoryStore: MemoryStore{records: make([]MatchRecord, 0)}, file: file}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record MatchRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			file.Close()
+			return nil, err
+		}
+		store.records = append(store.records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *FileStore) SaveMatch(record MatchRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.records = append(s.records, record)
+	return nil
+}
+
+// Close makes sure every match has reached the disk before closing the file.
+func (s *FileStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// serveHistory serves the match history of the player named in the query string as JSON.
+func serveHistory(store Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		history, err := store.History(r.URL.Query().Get("player"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(history)
+	})
+}
+
+// serveStats serves the totals of the player named in the query string as JSON.
+func serveStats(store Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats, err := store.Stats(r.URL.Query().Get("player"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testMatches are three matches between alice, bob and carol, oldest first: alice beats bob, bob beats alice by forfeit, and alice
+// draws with carol.
+func testMatches() []MatchRecord {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	return []MatchRecord{
+		{Date: start, Players: [2]string{"alice", "bob"}, Winner: "alice", Rules: DEFAULT_RULES, Ticks: 1000,
+			Stats: [2]BattleStats{{DamageDealt: 100, Counters: 2, Blocks: 3}, {DamageDealt: 40, Dodges: 1}}},
+		{Date: start.Add(time.Hour), Players: [2]string{"bob", "alice"}, Winner: "bob", Forfeit: true, Rules: DEFAULT_RULES, Ticks: 500,
+			Stats: [2]BattleStats{{DamageDealt: 10}, {DamageDealt: 20, InterruptsWon: 1}}},
+		{Date: start.Add(2 * time.Hour), Players: [2]string{"alice", "carol"}, Rules: DEFAULT_RULES, Ticks: 9000,
+			Stats: [2]BattleStats{{DamageDealt: 30}, {DamageDealt: 30}}},
+	}
+}
+
+// checkStore checks a store that has had testMatches saved to it.
+func checkStore(t *testing.T, store Store) {
+	t.Helper()
+	history, err := store.History("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].Players[1] != "carol" || history[2].Players[1] != "bob" {
+		t.Fatalf("alice's history should be all three matches, newest first: %+v", history)
+	}
+	history, err = store.History("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Winner != "" {
+		t.Fatalf("carol's history should be the draw: %+v", history)
+	}
+	if history, err = store.History("nobody"); err != nil || len(history) != 0 {
+		t.Fatalf("nobody's history should be empty: %+v, %v", history, err)
+	}
+
+	stats, err := store.Stats("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PlayerStats{Player: "alice", Matches: 3, Wins: 1, Losses: 1, Draws: 1, Forfeits: 1, Ticks: 10500, DamageDealt: 150, DamageTaken: 80,
+		Counters: 2, InterruptsWon: 1, Blocks: 3}
+	if stats != want {
+		t.Fatalf("alice's stats are %+v, want %+v", stats, want)
+	}
+	stats, err = store.Stats("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The forfeit was alice's, so it doesn't count against bob.
+	want = PlayerStats{Player: "bob", Matches: 2, Wins: 1, Losses: 1, Ticks: 1500, DamageDealt: 50, DamageTaken: 120, Dodges: 1}
+	if stats != want {
+		t.Fatalf("bob's stats are %+v, want %+v", stats, want)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	for _, record := range testMatches() {
+		if err := store.SaveMatch(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkStore(t, store)
+}
+
+func TestFileStoreReadsBackWhatItSaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "matches.jsonl")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range testMatches() {
+		if err := store.SaveMatch(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkStore(t, store)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	checkStore(t, store)
+}
@@ -0,0 +1,320 @@
+/*
+ * Copyright (c) 2018, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Training matches use this dummy if the player doesn't pick one.
+const DEFAULT_DUMMY string = "stand"
+
+// How many cycles the dummy waits before pressing the arrow in an interrupt, which is about as fast as a quick human. Beating it is
+// what the interrupt race is about.
+const DUMMY_ARROW_TICKS int = 25
+
+// The chance each cycle that the dummy starts a heavy attack when it's attacking at random and is free to.
+const DUMMY_HEAVY_CHANCE float64 = 0.01
+
+// A DummyBehavior is one way the training dummy can play. Decide gets what the dummy sees and returns the command it's holding.
+// Every dummy but the one that stands still answers interrupt arrows, after DUMMY_ARROW_TICKS.
+type DummyBehavior struct {
+	Name        string
+	Description string
+	decide      func(d *Dummy, self, enemy PlayerStatus) string
+}
+
+var DUMMY_BEHAVIORS = map[string]DummyBehavior{
+	"stand": {Name: "stand", Description: "stands still", decide: func(d *Dummy, self, enemy PlayerStatus) string {
+		return "NONE"
+	}},
+	"block": {Name: "block", Description: "always blocks", decide: func(d *Dummy, self, enemy PlayerStatus) string {
+		return "BLOCK"
+	}},
+	// Blocking only once an attack has started is what makes a block reactive, so every blocked light attack gets countered.
+	"counter": {Name: "counter", Description: "blocks each attack as it comes, so light attacks get countered", decide: func(d *Dummy, self, enemy PlayerStatus) string {
+		if ATTACK_STATES[enemy.State] {
+			return "BLOCK"
+		}
+		return "NONE"
+	}},
+	"heavy": {Name: "heavy", Description: "starts heavy attacks at random", decide: func(d *Dummy, self, enemy PlayerStatus) string {
+		if INTERRUPTABLE_STATES[self.State] && self.Stamina >= d.Rules.HeavyAttackCost && d.random.Float64() < DUMMY_HEAVY_CHANCE {
+			return "HEAVY"
+		}
+		return "NONE"
+	}},
+	"dodge": {Name: "dodge", Description: "dodges every attack it has time to", decide: func(d *Dummy, self, enemy PlayerStatus) string {
+		if ATTACK_STATES[enemy.State] && enemy.StateDuration > d.Rules.DodgeWindow {
+			return "DODGE"
+		}
+		return "NONE"
+	}},
+}
+
+// listDummyBehaviors describes the dummies players can pick for training.
+func listDummyBehaviors() string {
+	descriptions := make([]string, 0, len(DUMMY_BEHAVIORS))
+	for _, name := range dummyNames() {
+		descriptions = append(descriptions, name+" ("+DUMMY_BEHAVIORS[name].Description+")")
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+func dummyNames() []string {
+	names := make([]string, 0, len(DUMMY_BEHAVIORS))
+	for name := range DUMMY_BEHAVIORS {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A Dummy is the computer player in a training match. Unlike an AIPlayer it isn't trying to win, it just does the same thing over and
+// over so that the player can practice against it.
+type Dummy struct {
+	Behavior DummyBehavior
+	Rules    *Rules
+	// The behaviors the player switches to during training come through here. It's nil for dummies that never switch.
+	Behaviors <-chan DummyBehavior
+	random    *rand.Rand
+	// The tick of the newest update.
+	tick int
+	// The tick the dummy first saw the arrow it has to press, or -1 if it doesn't have one.
+	arrowSince  int
+	lastCommand string
+}
+
+func NewDummy(behavior DummyBehavior, rules *Rules, seed int64) *Dummy {
+	return &Dummy{Behavior: behavior, Rules: rules, random: rand.New(rand.NewSource(seed)), arrowSince: -1}
+}
+
+// Act takes the newest Update and returns the command to send, or an empty string if it's the same as the last one.
+func (d *Dummy) Act(update Update) string {
+	select {
+	case behavior := <-d.Behaviors:
+		d.Behavior = behavior
+		// Whatever the old behavior was holding, like a block, is let go of if the new one doesn't want it.
+		d.lastCommand = ""
+	default:
+	}
+	d.tick = update.Tick
+	command := "NONE"
+	if arrow := STATES[update.Self.State].Arrow; arrow != "" && d.Behavior.Name != "stand" {
+		if d.arrowSince < 0 {
+			d.arrowSince = update.Tick
+		}
+		if update.Tick-d.arrowSince >= DUMMY_ARROW_TICKS {
+			command = "INTERRUPT_" + strings.ToUpper(arrow)
+		}
+	} else {
+		d.arrowSince = -1
+		command = d.Behavior.decide(d, update.Self, update.Enemy)
+	}
+	if command == d.lastCommand {
+		return ""
+	}
+	d.lastCommand = command
+	return command
+}
+
+// TrainingSettings are the toggles a player has in a training match. They apply to both sides, so the dummy can't be knocked out
+// either while infinite life is on.
+type TrainingSettings struct {
+	InfiniteLife    bool `json:"infiniteLife"`
+	InfiniteStamina bool `json:"infiniteStamina"`
+}
+
+// A TrainingChange is sent to the battle when the player changes a setting or resets the fight.
+type TrainingChange struct {
+	Settings TrainingSettings
+	Reset    bool
+}
+
+// Training is the part of a training match the dispatcher keeps track of. The dispatcher has the current settings, and sends changes
+// to the battle through Changes and new behaviors to the dummy through Behaviors, which the dummy picks up on its next update.
+// Recording is set while the dummy is playing one, and Jitter is how much it shifts the waits in it. See recording.go.
+type Training struct {
+	Settings  TrainingSettings
+	Dummy     string
+	Recording *Recording
+	Jitter    int
+	Changes   chan TrainingChange
+	Behaviors chan DummyBehavior
+}
+
+func (t *Training) status() Envelope {
+	status := TrainingStatus{Dummy: t.Dummy, Dummies: dummyNames(), Jitter: t.Jitter, TrainingSettings: t.Settings}
+	if t.Recording != nil {
+		status.Recording = t.Recording.ID
+		status.Sequence = t.Recording.String()
+	}
+	return NewEnvelope(TYPE_TRAINING, status)
+}
+
+// applyTraining is called at the end of every cycle. Life is refilled when it runs out rather than kept full, so that players can
+// still see how much damage they're doing.
+func (s *Simulation) applyTraining() {
+	for p := range s.Players {
+		player := &s.Players[p]
+		if s.Training.InfiniteLife && player.Life <= 0 {
+			player.Life = s.Rules.StartingLife
+		}
+		if s.Training.InfiniteStamina {
+			player.Stamina = s.Rules.MaxStamina
+		}
+	}
+}
+
+// Reset puts both players back where they started, without starting a new round.
+func (s *Simulation) Reset() {
+	s.RoundTick = 0
+	s.Break = 0
+	s.resetPlayers()
+}
+
+// The commands a player can use during a training match.
+var TRAINING_COMMANDS = map[string]bool{
+	"DUMMY":            true,
+	"INFINITE LIFE":    true,
+	"INFINITE STAMINA": true,
+	"RESET":            true,
+	"END TRAINING":     true,
+	"RECORD":           true,
+	"PLAYBACK":         true,
+	"JITTER":           true,
+}
+
+// startTraining starts a training match between a user and a dummy, under the rules of the user's room but without a time limit, and
+// with only the one round.
+func (l *lobby) startTraining(conn *ConnInfo, behaviorName string) string {
+	if behaviorName == "" {
+		behaviorName = DEFAULT_DUMMY
+	}
+	behavior, ok := DUMMY_BEHAVIORS[behaviorName]
+	if !ok {
+		return "There is no dummy called " + behaviorName + ". Pick one of " + listDummyBehaviors() + "."
+	}
+	rules := *l.clients[conn].Room.Rules
+	rules.Rounds, rules.RoundTime = 1, 0
+	training := &Training{Dummy: behavior.Name, Changes: make(chan TrainingChange), Behaviors: make(chan DummyBehavior, 1)}
+	conn.Outbound <- serverMessage("You are training against a dummy that " + behavior.Description + ". The training controls are below the fight.")
+	dummyInputs, dummyUpdates := l.startComputerMatch(conn, "dummy", &rules, training)
+	conn.Outbound <- training.status()
+	dummy := NewDummy(behavior, &rules, time.Now().UnixNano())
+	dummy.Behaviors = training.Behaviors
+	go runBot(dummy, dummyUpdates, dummyInputs)
+	return ""
+}
+
+// handleTrainingCommand carries out a command from a player in a training match.
+func (l *lobby) handleTrainingCommand(msg MessageInfo) {
+	match := msg.User.Match
+	training := match.Training
+	command, argument := msg.Request.Command.Command, msg.Request.Command.Argument
+	change := TrainingChange{Settings: training.Settings}
+	var err *ProtocolError
+	switch command {
+	case "DUMMY":
+		behavior, ok := DUMMY_BEHAVIORS[argument]
+		if !ok {
+			msg.Conn.Outbound <- serverMessage("There is no dummy called " + argument + ". Pick one of " + listDummyBehaviors() + ".")
+			return
+		}
+		setDummy(msg, behavior, nil)
+		return
+	case "RECORD":
+		steps, parseErr := parseRecording(argument)
+		if parseErr != nil {
+			msg.Conn.Outbound <- serverMessage("That recording doesn't work: " + parseErr.Error() + ".")
+			return
+		}
+		recording, saveErr := l.recordings.Save(msg.User.Name, steps)
+		if saveErr != nil {
+			logError("failed to save recording:", saveErr)
+			msg.Conn.Outbound <- serverMessage("Your recording couldn't be saved.")
+			return
+		}
+		msg.Conn.Outbound <- serverMessage("Saved recording " + recording.ID + ". Anyone can train against it with /playback " + recording.ID + ".")
+		setDummy(msg, recording.behavior(training.Jitter, time.Now().UnixNano()), recording)
+		return
+	case "PLAYBACK":
+		recording, ok := l.recordings.Get(argument)
+		if !ok {
+			msg.Conn.Outbound <- serverMessage("There is no recording " + argument + ".")
+			return
+		}
+		setDummy(msg, recording.behavior(training.Jitter, time.Now().UnixNano()), recording)
+		return
+	case "JITTER":
+		jitter, convErr := strconv.Atoi(argument)
+		if convErr != nil || jitter < 0 || jitter > MAX_JITTER {
+			msg.Conn.Outbound <- errorEnvelope(protocolError(ERROR_INVALID, TYPE_COMMAND, "JITTER takes a number of ticks from 0 to %d", MAX_JITTER))
+			return
+		}
+		training.Jitter = jitter
+		if training.Recording == nil {
+			msg.Conn.Outbound <- training.status()
+			return
+		}
+		setDummy(msg, training.Recording.behavior(jitter, time.Now().UnixNano()), training.Recording)
+		return
+	case "INFINITE LIFE":
+		change.Settings.InfiniteLife, err = toggle(command, argument, training.Settings.InfiniteLife)
+	case "INFINITE STAMINA":
+		change.Settings.InfiniteStamina, err = toggle(command, argument, training.Settings.InfiniteStamina)
+	case "RESET":
+		change.Reset = true
+		// A recording starts over too, so that the situation it drills comes up the same way every time.
+		if training.Recording != nil {
+			setDummy(msg, training.Recording.behavior(training.Jitter, time.Now().UnixNano()), training.Recording)
+		}
+	case "END TRAINING":
+		match.stopBattle()
+		return
+	}
+	if err != nil {
+		msg.Conn.Outbound <- errorEnvelope(err)
+		return
+	}
+	select {
+	case training.Changes <- change:
+	case <-match.Done:
+		return
+	}
+	training.Settings = change.Settings
+	msg.Conn.Outbound <- training.status()
+}
+
+// setDummy has the dummy switch to a new behavior, which plays recording if it isn't nil.
+func setDummy(msg MessageInfo, behavior DummyBehavior, recording *Recording) {
+	training := msg.User.Match.Training
+	select {
+	case training.Behaviors <- behavior:
+	case <-msg.User.Match.Done:
+		return
+	}
+	training.Dummy = behavior.Name
+	training.Recording = recording
+	msg.Conn.Outbound <- training.status()
+}
+
+// toggle works out a setting from the argument of the command that changes it, which is "on", "off", or nothing to flip it.
+func toggle(command, argument string, current bool) (bool, *ProtocolError) {
+	switch argument {
+	case "":
+		return !current, nil
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return current, protocolError(ERROR_INVALID, TYPE_COMMAND, "%s takes on or off, not %q", command, argument)
+}